@@ -0,0 +1,209 @@
+package baker
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alinz/baker.go/rule"
+)
+
+type adminContainer struct {
+	ID                  string `json:"id"`
+	Addr                string `json:"addr"`
+	Version             string `json:"version"`
+	ActiveConnections   int64  `json:"active_connections"`
+	UpgradedConnections int    `json:"upgraded_connections"`
+	Draining            bool   `json:"draining"`
+}
+
+type adminRoute struct {
+	Domain     string            `json:"domain"`
+	Path       string            `json:"path"`
+	PathType   string            `json:"path_type"`
+	Split      *Split            `json:"split"`
+	Requests   map[string]uint64 `json:"requests"`
+	Containers []adminContainer  `json:"containers"`
+}
+
+func newAdminRoute(domain, path, pathType string, service *Service) adminRoute {
+	route := adminRoute{
+		Domain:     domain,
+		Path:       path,
+		PathType:   pathType,
+		Split:      service.Split(),
+		Requests:   service.Requests(),
+		Containers: make([]adminContainer, 0),
+	}
+
+	service.containers.Iterate(func(_ string, value *value) bool {
+		route.Containers = append(route.Containers, adminContainer{
+			ID:                  value.container.ID,
+			Addr:                value.container.Addr.String(),
+			Version:             value.endpoint.Version,
+			ActiveConnections:   value.container.ActiveConnections(),
+			UpgradedConnections: value.container.UpgradedConnections(),
+			Draining:            value.container.Draining(),
+		})
+		return true
+	})
+
+	sort.Slice(route.Containers, func(i, j int) bool {
+		return route.Containers[i].ID < route.Containers[j].ID
+	})
+
+	return route
+}
+
+func (s *Server) routes() []adminRoute {
+	routes := make([]adminRoute, 0)
+
+	s.domains.paths.Iterate(func(domain string, paths *Paths) bool {
+		paths.registeredPath.Iterate(func(path string, service *Service) bool {
+			routes = append(routes, newAdminRoute(domain, path, PathTypeTrie, service))
+			return true
+		})
+
+		paths.registeredExpr.Iterate(func(path string, service *Service) bool {
+			routes = append(routes, newAdminRoute(domain, path, PathTypeRegex, service))
+			return true
+		})
+
+		return true
+	})
+
+	s.layer4.Iterate(func(key string, service *Service) bool {
+		pathType, name, _ := strings.Cut(key, "/")
+		if pathType == "sni" {
+			routes = append(routes, newAdminRoute(name, "", pathType, service))
+		} else {
+			routes = append(routes, newAdminRoute("", ":"+name, pathType, service))
+		}
+		return true
+	})
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Domain != routes[j].Domain {
+			return routes[i].Domain < routes[j].Domain
+		}
+		return routes[i].Path < routes[j].Path
+	})
+
+	return routes
+}
+
+// purge removes the responses of domain whose path starts with path
+// from every rule which keeps responses
+func (s *Server) purge(domain string, path string) int {
+	purged := 0
+
+	s.middlewareCacheMap.Iterate(func(_ string, middleware rule.Middleware) bool {
+		if purger, ok := middleware.(rule.Purger); ok {
+			purged += purger.Purge(domain, path)
+		}
+		return true
+	})
+
+	return purged
+}
+
+// Admin returns a handler exposing the internal state of baker. It should only
+// be served on an address which is not reachable from the outside.
+//
+// GET /routes lists every registered route, its containers, traffic split and
+// the number of requests routed to each version. The routes of TCP, UDP and
+// SNI endpoints have the path type tcp, udp and sni. Each container reports its
+// requests in progress, its upgraded connections and whether it is draining.
+//
+// POST /drain?id=container&enabled=true stops routing new requests to a
+// container, or resumes it with enabled=false.
+//
+// GET /maintenance lists the domains in maintenance, and
+// POST /maintenance?domain=example.com&enabled=true puts a domain in
+// maintenance, or takes it out of maintenance with enabled=false.
+//
+// POST /cache/purge?domain=example.com&path=/static/ removes the cached
+// responses of a domain whose path starts with path. Both are optional.
+func (s *Server) Admin() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.routes())
+	})
+
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			query := r.URL.Query()
+
+			domain := query.Get("domain")
+			enabled, err := strconv.ParseBool(query.Get("enabled"))
+			if domain == "" || err != nil {
+				http.Error(w, "domain and enabled are required", http.StatusBadRequest)
+				return
+			}
+
+			s.SetMaintenance(domain, enabled)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		domains := make([]string, 0)
+		s.maintenance.Iterate(func(domain string, _ bool) bool {
+			domains = append(domains, domain)
+			return true
+		})
+		sort.Strings(domains)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"domains": domains})
+	})
+
+	mux.HandleFunc("/drain", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+
+		id := query.Get("id")
+		enabled, err := strconv.ParseBool(query.Get("enabled"))
+		if id == "" || err != nil {
+			http.Error(w, "id and enabled are required", http.StatusBadRequest)
+			return
+		}
+
+		if !s.SetDraining(id, enabled) {
+			http.Error(w, "container not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		query := r.URL.Query()
+		purged := s.purge(query.Get("domain"), query.Get("path"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+	})
+
+	return mux
+}
@@ -1,16 +1,23 @@
 package baker
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net/http"
 	"net/http/httputil"
 	"net/netip"
 	"net/url"
+	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/alinz/baker.go/pkg/certstore"
 	"github.com/alinz/baker.go/pkg/collection"
+	"github.com/alinz/baker.go/pkg/grpchealth"
 	"github.com/alinz/baker.go/pkg/httpclient"
 	"github.com/alinz/baker.go/pkg/log"
 	"github.com/alinz/baker.go/rule"
@@ -26,28 +33,209 @@ type Endpoint struct {
 	Path   string `json:"path"`
 	Rules  []Rule `json:"rules"`
 	Ready  bool   `json:"ready"`
+	// ParamHeaderPrefix, if set, forwards every named path parameter
+	// to the container as a header, e.g. `X-Param-` sends `:id` as `X-Param-Id`
+	ParamHeaderPrefix string `json:"param_header_prefix"`
+	// Match, if set, restricts the endpoint to requests matching its conditions
+	Match *Match `json:"match"`
+	// PathType is either `trie` (default) or `regex`. Regex paths must match
+	// the whole request path and their named groups are captured as path parameters
+	PathType string `json:"path_type"`
+	// Version labels the endpoint, so the traffic of a route
+	// can be split between versions, see Split
+	Version string `json:"version"`
+	// Split, if set, distributes the traffic of the route between versions.
+	// It only needs to be declared by one of the endpoints sharing the route.
+	Split *Split `json:"split"`
+	// Balance is either `random` (default) or `least_conn`, which selects the
+	// container with the fewest requests in progress, upgraded connections included
+	Balance string `json:"balance"`
+	// Upgrade, if set, configures the upgraded connections, e.g. WebSocket
+	Upgrade *Upgrade `json:"upgrade"`
+	// HTTP2 proxies the requests to the container over HTTP/2 without TLS (h2c).
+	// gRPC requests always are.
+	HTTP2 bool `json:"http2"`
+	// HealthCheck, if set, only routes requests to the container
+	// while it reports itself as serving
+	HealthCheck *HealthCheck `json:"health_check"`
+	// Port, if set, proxies the raw connections, or the datagrams if Protocol
+	// is udp, received by baker on that port, see Server.ServeTCP and
+	// Server.ServeUDP. Domain and Path are ignored.
+	Port int `json:"port"`
+	// Protocol of Port, either `tcp` (default) or `udp`
+	Protocol string `json:"protocol"`
+	// SNI, if set, proxies the TLS connections whose server name is SNI, without
+	// terminating them, see Server.ServeSNI. It can be a wildcard, e.g. *.example.com
+	SNI string `json:"sni"`
+	// TargetPort is the port of the container the connections of Port
+	// and SNI are proxied to, the port of the container by default
+	TargetPort int `json:"target_port"`
+	// IdleTimeout closes the connections of Port and SNI, and expires the
+	// UDP sessions, once nothing is exchanged for that long
+	IdleTimeout rule.Duration `json:"idle_timeout"`
+	// Certificate, if set, is served for Domain instead of one issued by ACME,
+	// e.g. for a domain of a corporate CA, see WithCertStore
+	Certificate *Certificate `json:"certificate"`
 }
 
+// Certificate references a certificate and its key, both PEM encoded files
+// on the host of baker. Relative paths are relative to the store's directory.
+type Certificate struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+const HealthCheckGRPC = "grpc"
+
+// HealthCheck checks the container using the gRPC health checking protocol
+// each time its config is fetched. Service is the name of the checked service,
+// the overall health of the server if empty.
+type HealthCheck struct {
+	Type    string `json:"type"`
+	Service string `json:"service"`
+}
+
+const (
+	PathTypeTrie  = "trie"
+	PathTypeRegex = "regex"
+)
+
+const (
+	BalanceRandom    = "random"
+	BalanceLeastConn = "least_conn"
+)
+
 func (e *Endpoint) getHashKey() string {
+	if e.isLayer4() {
+		return e.layer4Key()
+	}
+
 	var sb strings.Builder
 
 	sb.WriteString(e.Domain)
 	sb.WriteString(e.Path)
 
+	if e.Match != nil {
+		sb.WriteString(e.Match.key())
+	}
+
 	return sb.String()
 }
 
+// getMiddlewareKey returns the key of a cached middleware, each endpoint
+// can have one cached middleware per rule type
+func (e *Endpoint) getMiddlewareKey(ruleType string) string {
+	return e.getHashKey() + "|" + ruleType
+}
+
+func (e *Endpoint) hasRule(ruleType string) bool {
+	for _, r := range e.Rules {
+		if r.Type == ruleType {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the endpoint and compiles its regular expressions
+func (e *Endpoint) validate() error {
+	if err := e.validateLayer4(); err != nil {
+		return err
+	}
+
+	switch e.PathType {
+	case "", PathTypeTrie:
+	case PathTypeRegex:
+		if _, err := compilePathRegexp(e.Path); err != nil {
+			return fmt.Errorf("invalid regex path: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown path type %q", e.PathType)
+	}
+
+	if e.Match != nil {
+		if err := e.Match.compile(); err != nil {
+			return fmt.Errorf("invalid match: %w", err)
+		}
+	}
+
+	if e.Split != nil {
+		if err := e.Split.validate(); err != nil {
+			return fmt.Errorf("invalid split: %w", err)
+		}
+	}
+
+	switch e.Balance {
+	case "", BalanceRandom, BalanceLeastConn:
+	default:
+		return fmt.Errorf("unknown balance %q", e.Balance)
+	}
+
+	if e.Upgrade != nil {
+		if err := e.Upgrade.validate(); err != nil {
+			return fmt.Errorf("invalid upgrade: %w", err)
+		}
+	}
+
+	if e.HealthCheck != nil && e.HealthCheck.Type != HealthCheckGRPC {
+		return fmt.Errorf("unknown health check type %q", e.HealthCheck.Type)
+	}
+
+	if e.Certificate != nil {
+		if e.Domain == "" || e.isLayer4() {
+			return fmt.Errorf("certificate requires a domain")
+		}
+		if e.Certificate.CertFile == "" || e.Certificate.KeyFile == "" {
+			return fmt.Errorf("certificate requires a cert file and a key file")
+		}
+	}
+
+	return nil
+}
+
+func (e *Endpoint) matches(r *http.Request) bool {
+	return e.Match == nil || e.Match.matches(r)
+}
+
+func (e *Endpoint) priority() (int, int) {
+	if e.Match == nil {
+		return 0, 0
+	}
+	return e.Match.Priority, e.Match.specificity()
+}
+
 type Container struct {
 	ID   string         `json:"id"`
 	Addr netip.AddrPort `json:"addr"`
 	Path string         `json:"path"`
+
+	active   atomic.Int64
+	draining atomic.Bool
+	conns    connections
+}
+
+// ActiveConnections returns the number of requests in progress,
+// including the upgraded connections
+func (c *Container) ActiveConnections() int64 {
+	return c.active.Load()
+}
+
+// UpgradedConnections returns the number of upgraded connections, e.g. WebSocket
+func (c *Container) UpgradedConnections() int {
+	return c.conns.len()
+}
+
+// Draining reports whether new requests are no longer routed to the container
+func (c *Container) Draining() bool {
+	return c.draining.Load()
 }
 
 var emptyPaths = NewPaths()
 var emptyService = NewService()
 
 type Domains struct {
-	paths *collection.Map[*Paths]
+	paths      *collection.Map[*Paths]
+	regexFirst bool
 }
 
 func NewDomains() *Domains {
@@ -64,14 +252,56 @@ func (d *Domains) Paths(domain string, insert bool) *Paths {
 	}
 
 	p := NewPaths()
+	p.regexFirst = d.regexFirst
 	d.paths.Put(domain, p)
 
 	return p
 }
 
+// Has reports whether domain has at least one container
+func (d *Domains) Has(domain string) bool {
+	p, ok := d.paths.Get(domain)
+	return ok && p.hasContainers()
+}
+
+// Endpoint returns the service that holds the containers of endpoint
+func (d *Domains) Endpoint(endpoint *Endpoint, insert bool) *Service {
+	paths := d.Paths(endpoint.Domain, insert)
+
+	if endpoint.PathType == PathTypeRegex {
+		return paths.Regex(endpoint.Path, insert)
+	}
+
+	return paths.Service(endpoint.Path, insert)
+}
+
+type regexPath struct {
+	regex   *regexp.Regexp
+	service *Service
+}
+
 type Paths struct {
 	services       *collection.Trie[*Service]
 	registeredPath *collection.Map[*Service]
+	regexPaths     *collection.Slice[*regexPath]
+	registeredExpr *collection.Map[*Service]
+	regexFirst     bool
+}
+
+func (p *Paths) hasContainers() bool {
+	found := false
+
+	check := func(_ string, service *Service) bool {
+		found = service.containers.Len() > 0
+		return !found
+	}
+
+	p.registeredPath.Iterate(check)
+	if !found {
+		p.registeredExpr.Iterate(check)
+	}
+
+	return found
 }
 
 func (p *Paths) Service(path string, insert bool) *Service {
@@ -98,10 +328,106 @@ func (p *Paths) Service(path string, insert bool) *Service {
 	return s
 }
 
+// Regex returns the service registered for the regex path expr.
+// Regex paths are evaluated in the order they are registered.
+func (p *Paths) Regex(expr string, insert bool) *Service {
+	if s, ok := p.registeredExpr.Get(expr); ok {
+		return s
+	} else if !insert {
+		return emptyService
+	}
+
+	regex, err := compilePathRegexp(expr)
+	if err != nil {
+		log.Error().Err(err).Str("path", expr).Msg("failed to compile regex path")
+		return emptyService
+	}
+
+	s := NewService()
+	p.regexPaths.Put(&regexPath{
+		regex:   regex,
+		service: s,
+	})
+	p.registeredExpr.Put(expr, s)
+
+	return s
+}
+
+// Route selects a container for r. Trie paths are checked first and
+// regex paths are only evaluated if none of the trie paths can serve r,
+// unless the regex paths take precedence.
+func (p *Paths) Route(r *http.Request) (*Container, *Endpoint, collection.Params, bool) {
+	lookups := []func(r *http.Request) (*Container, *Endpoint, collection.Params, bool){
+		p.routeTrie,
+		p.routeRegex,
+	}
+
+	if p.regexFirst {
+		lookups[0], lookups[1] = lookups[1], lookups[0]
+	}
+
+	for _, lookup := range lookups {
+		if container, endpoint, params, ok := lookup(r); ok {
+			return container, endpoint, params, true
+		}
+	}
+
+	return nil, nil, nil, false
+}
+
+func (p *Paths) routeTrie(r *http.Request) (*Container, *Endpoint, collection.Params, bool) {
+	service, params := p.Match(r.URL.Path)
+
+	container, endpoint, ok := service.Route(r)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	return container, endpoint, params, true
+}
+
+func (p *Paths) routeRegex(r *http.Request) (container *Container, endpoint *Endpoint, params collection.Params, ok bool) {
+	p.regexPaths.Iterate(func(regexPath *regexPath) bool {
+		matches := regexPath.regex.FindStringSubmatch(r.URL.Path)
+		if matches == nil {
+			return true
+		}
+
+		container, endpoint, ok = regexPath.service.Route(r)
+		if !ok {
+			return true
+		}
+
+		params = make(collection.Params)
+		for i, name := range regexPath.regex.SubexpNames() {
+			if name != "" {
+				params[name] = matches[i]
+			}
+		}
+
+		return false
+	})
+
+	return
+}
+
+// Match looks up the service registered for path and returns
+// the named parameters captured by the matched pattern
+func (p *Paths) Match(path string) (*Service, collection.Params) {
+	s, params, ok := p.services.Match([]rune(path))
+	if !ok {
+		return emptyService, nil
+	}
+
+	return s, params
+}
+
 func NewPaths() *Paths {
 	return &Paths{
 		services:       collection.NewTrie[*Service](),
 		registeredPath: collection.NewMap[*Service](),
+		regexPaths:     collection.NewSlice[*regexPath](),
+		registeredExpr: collection.NewMap[*Service](),
 	}
 }
 
@@ -110,35 +436,102 @@ type value struct {
 	endpoint  *Endpoint
 }
 
+func (v *value) getKey() string {
+	return v.container.ID + "|" + v.endpoint.getHashKey()
+}
+
 type Service struct {
 	containers *collection.Set[string, *value]
+	split      atomic.Pointer[Split]
+	requests   *collection.Map[*atomic.Uint64]
+}
+
+// Split returns the traffic split of the service, nil if there is none
+func (s *Service) Split() *Split {
+	return s.split.Load()
+}
+
+// Requests returns the number of requests routed to each version
+func (s *Service) Requests() map[string]uint64 {
+	requests := make(map[string]uint64)
+
+	s.requests.Iterate(func(version string, counter *atomic.Uint64) bool {
+		requests[version] = counter.Load()
+		return true
+	})
+
+	return requests
 }
 
 func (s *Service) Add(container *Container, endpoint *Endpoint) {
-	if !s.containers.Contains(container.ID) {
+	value := &value{
+		container: container,
+		endpoint:  endpoint,
+	}
+
+	key := value.getKey()
+
+	if !s.containers.Contains(key) {
 		log.Info().
 			Str("id", container.ID).
 			Str("domain", endpoint.Domain).
 			Str("path", endpoint.Path).
 			Msg("a new container is added")
 	}
-	s.containers.Put(container.ID, &value{
-		container: container,
-		endpoint:  endpoint,
+	s.containers.Put(key, value)
+
+	s.updateSplit()
+}
+
+// updateSplit uses the split declared by the endpoints of the remaining
+// containers, the one of the smallest key if several do, so removing a split
+// from the configs, or the container declaring it, removes it from the service
+func (s *Service) updateSplit() {
+	var split *Split
+	var splitKey string
+
+	s.containers.Iterate(func(key string, value *value) bool {
+		if value.endpoint.Split != nil && (split == nil || key < splitKey) {
+			split, splitKey = value.endpoint.Split, key
+		}
+		return true
 	})
+
+	s.split.Store(split)
 }
 
+// Remove removes every endpoint registered by container
+// and returns the number of remaining ones
 func (s *Service) Remove(container *Container) int {
-	value, ok := s.containers.Get(container.ID)
-	if ok {
-		log.Info().
-			Str("id", container.ID).
-			Str("domain", value.endpoint.Domain).
-			Str("path", value.endpoint.Path).
-			Msg("an exisiting container is removed")
+	keys := make([]string, 0)
+
+	s.containers.Iterate(func(key string, value *value) bool {
+		if value.container.ID == container.ID {
+			keys = append(keys, key)
+		}
+		return true
+	})
+
+	remaining := s.containers.Len()
+
+	for _, key := range keys {
+		value, ok := s.containers.Get(key)
+		if ok {
+			log.Info().
+				Str("id", container.ID).
+				Str("domain", value.endpoint.Domain).
+				Str("path", value.endpoint.Path).
+				Msg("an exisiting container is removed")
+		}
+
+		remaining = s.containers.Remove(key)
 	}
 
-	return s.containers.Remove(container.ID)
+	if len(keys) > 0 {
+		s.updateSplit()
+	}
+
+	return remaining
 }
 
 func (s *Service) Select() (*Container, *Endpoint, bool) {
@@ -149,21 +542,102 @@ func (s *Service) Select() (*Container, *Endpoint, bool) {
 	return value.container, value.endpoint, true
 }
 
+// Route selects a container whose endpoint matches r. If more than one endpoint
+// matches, only the ones with the highest priority are considered.
+func (s *Service) Route(r *http.Request) (*Container, *Endpoint, bool) {
+	var candidates []*value
+	var bestPriority, bestSpecificity int
+
+	s.containers.Iterate(func(_ string, value *value) bool {
+		if value.container.Draining() || !value.endpoint.matches(r) {
+			return true
+		}
+
+		priority, specificity := value.endpoint.priority()
+
+		switch {
+		case len(candidates) == 0,
+			priority > bestPriority,
+			priority == bestPriority && specificity > bestSpecificity:
+			candidates = append(candidates[:0], value)
+			bestPriority, bestSpecificity = priority, specificity
+		case priority == bestPriority && specificity == bestSpecificity:
+			candidates = append(candidates, value)
+		}
+
+		return true
+	})
+
+	if len(candidates) == 0 {
+		return nil, nil, false
+	}
+
+	if split := s.split.Load(); split != nil {
+		candidates = split.pick(r, candidates)
+	}
+
+	value := balance(candidates)
+
+	s.requests.GetAndUpdate(value.endpoint.Version, func(counter *atomic.Uint64, found bool) *atomic.Uint64 {
+		if !found {
+			counter = &atomic.Uint64{}
+		}
+		counter.Add(1)
+		return counter
+	})
+
+	return value.container, value.endpoint, true
+}
+
+// balance selects one of the candidates, the balance of the
+// endpoints sharing a route is expected to be the same
+func balance(candidates []*value) *value {
+	if candidates[0].endpoint.Balance != BalanceLeastConn {
+		return candidates[rand.Intn(len(candidates))]
+	}
+
+	// ties are broken randomly, so idle containers share the load
+	var least []*value
+	var min int64
+	for _, candidate := range candidates {
+		active := candidate.container.ActiveConnections()
+		switch {
+		case len(least) == 0, active < min:
+			least = append(least[:0], candidate)
+			min = active
+		case active == min:
+			least = append(least, candidate)
+		}
+	}
+
+	return least[rand.Intn(len(least))]
+}
+
 func NewService() *Service {
 	return &Service{
 		containers: collection.NewSet[string, *value](),
+		requests:   collection.NewMap[*atomic.Uint64](),
 	}
 }
 
 type Server struct {
 	domains            *Domains
+	layer4             *collection.Map[*Service]
 	rules              map[string]rule.BuilderFunc
 	pingDuration       time.Duration
 	containers         *collection.Set[string, *Container]
 	done               chan struct{}
 	http               httpclient.GetterFunc
-	refMap             *collection.Map[*value]
+	h2c                http.RoundTripper
+	healthClient       *http.Client
+	refMap             *collection.Map[[]*value]
 	middlewareCacheMap *collection.Map[rule.Middleware]
+	maintenance        *collection.Map[bool]
+	errorPages         *collection.Map[errorPage]
+	drainTimeout       time.Duration
+	maxUDPSessions     int
+	certStore          *certstore.Store
+	onNewDomain        func(domain string)
 	onAfterPinger      func(containerSet *collection.Set[string, *Container])
 }
 
@@ -175,6 +649,8 @@ func (s *Server) pinger() {
 		case <-s.done:
 			return
 		case <-time.After(s.pingDuration):
+			s.reloadMiddlewares()
+
 			s.containers.Iterate(func(id string, container *Container) bool {
 				configPath := fmt.Sprintf("http://%s%s", container.Addr, container.Path)
 				body, err := s.http(configPath)
@@ -199,7 +675,29 @@ func (s *Server) pinger() {
 					return true
 				}
 
+				values := make([]*value, 0, len(endpoints))
+				errorPages := make(map[string]bool)
+
 				for _, endpoint := range endpoints {
+					if err := endpoint.validate(); err != nil {
+						log.Error().
+							Err(err).
+							Str("id", container.ID).
+							Str("domain", endpoint.Domain).
+							Str("path", endpoint.Path).
+							Msg("invalid endpoint")
+						continue
+					}
+
+					if endpoint.HealthCheck != nil && !s.isHealthy(container, endpoint) {
+						s.service(endpoint, false).Remove(container)
+						continue
+					}
+
+					if endpoint.Certificate != nil {
+						s.assignCertificate(container, endpoint)
+					}
+
 					log.
 						Debug().
 						Str("domain", endpoint.Domain).
@@ -207,15 +705,40 @@ func (s *Server) pinger() {
 						Str("container_id", container.ID).
 						Msg("added/updated endpoint")
 
-					s.refMap.Put(container.ID, &value{
+					values = append(values, &value{
 						container: container,
 						endpoint:  endpoint,
 					})
 
-					s.domains.
-						Paths(endpoint.Domain, true).
-						Service(endpoint.Path, true).
-						Add(container, endpoint)
+					isNewDomain := !endpoint.isLayer4() && !s.domains.Has(endpoint.Domain)
+
+					s.service(endpoint, true).Add(container, endpoint)
+
+					if isNewDomain && s.onNewDomain != nil {
+						s.onNewDomain(endpoint.Domain)
+					}
+
+					if renderer, ok := s.errorRenderer(endpoint); ok {
+						s.errorPages.Put(endpoint.Domain, errorPage{containerID: container.ID, renderer: renderer})
+						errorPages[endpoint.Domain] = true
+					}
+				}
+
+				// the error pages of the domains which the container doesn't declare anymore
+				previous, _ := s.refMap.Get(container.ID)
+				for _, value := range previous {
+					if !errorPages[value.endpoint.Domain] {
+						s.removeErrorPage(value.endpoint.Domain, container.ID)
+					}
+				}
+
+				s.refMap.Put(container.ID, values)
+
+				// and the certificates the container doesn't declare anymore
+				for _, value := range previous {
+					if value.endpoint.Certificate != nil {
+						s.unassignCertificate(value.endpoint.Domain)
+					}
 				}
 
 				if s.onAfterPinger != nil {
@@ -228,20 +751,216 @@ func (s *Server) pinger() {
 	}
 }
 
+// reloadMiddlewares reloads the files of the cached middlewares,
+// outside of the lock of the cache, so requests are not blocked
+func (s *Server) reloadMiddlewares() {
+	var reloaders []rule.Reloader
+
+	s.middlewareCacheMap.Iterate(func(_ string, middleware rule.Middleware) bool {
+		if reloader, ok := middleware.(rule.Reloader); ok {
+			reloaders = append(reloaders, reloader)
+		}
+		return true
+	})
+
+	for _, reloader := range reloaders {
+		reloader.Reload()
+	}
+}
+
+// isHealthy runs the health check of endpoint against container
+func (s *Server) isHealthy(container *Container, endpoint *Endpoint) bool {
+	status, err := grpchealth.Check(context.Background(), s.healthClient, container.Addr.String(), endpoint.HealthCheck.Service)
+	if err != nil || status != grpchealth.StatusServing {
+		log.Error().
+			Err(err).
+			Str("id", container.ID).
+			Str("domain", endpoint.Domain).
+			Str("path", endpoint.Path).
+			Str("status", status.String()).
+			Msg("container is not healthy")
+		return false
+	}
+
+	return true
+}
+
+// HasDomain reports whether domain is routed to at least one container, it
+// can restrict the domains whose certificates are issued by ACME
+func (s *Server) HasDomain(domain string) bool {
+	return s.domains.Has(domain)
+}
+
+// assignCertificate serves the certificate of endpoint for its domain, the
+// endpoint is still routed if it can't be loaded, using ACME if enabled
+func (s *Server) assignCertificate(container *Container, endpoint *Endpoint) {
+	if s.certStore == nil {
+		log.Error().
+			Str("id", container.ID).
+			Str("domain", endpoint.Domain).
+			Msg("certificate ignored, no certificate store")
+		return
+	}
+
+	err := s.certStore.Assign(endpoint.Domain, endpoint.Certificate.CertFile, endpoint.Certificate.KeyFile)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("id", container.ID).
+			Str("domain", endpoint.Domain).
+			Str("cert_file", endpoint.Certificate.CertFile).
+			Msg("failed to load certificate")
+	}
+}
+
+// unassignCertificate stops serving the certificate of domain, unless an
+// endpoint of the domain still references one
+func (s *Server) unassignCertificate(domain string) {
+	if s.certStore == nil {
+		return
+	}
+
+	referenced := false
+	s.refMap.Iterate(func(_ string, values []*value) bool {
+		for _, value := range values {
+			if value.endpoint.Certificate != nil && strings.EqualFold(value.endpoint.Domain, domain) {
+				referenced = true
+				return false
+			}
+		}
+		return true
+	})
+
+	if !referenced {
+		s.certStore.Unassign(domain)
+	}
+}
+
+// RequestIDHeader carries the id of a request, if the client doesn't send one,
+// baker generates it. It is forwarded to the container and sent back to the client.
+const RequestIDHeader = "X-Request-Id"
+
+func serviceUnavailable(w http.ResponseWriter, r *http.Request) {
+	rule.Error(w, r, http.StatusServiceUnavailable, "service is not available")
+}
+
+// SetMaintenance puts a domain in maintenance, or takes it out of maintenance.
+// The requests of a domain in maintenance are served by its Maintenance rule,
+// or by a default one if its endpoints don't have any.
+func (s *Server) SetMaintenance(domain string, enabled bool) {
+	if enabled {
+		s.maintenance.Put(domain, true)
+	} else {
+		s.maintenance.Delete(domain)
+	}
+}
+
+// proxyErrorHandler maps the errors of the proxy to a status code, the
+// limits set by rules are reported as 413 and 504 instead of 502
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	message := "failed to reach the service"
+
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		status = http.StatusRequestEntityTooLarge
+		message = "request body is too large"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(context.Cause(r.Context()), context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+		message = "service took too long to respond"
+	}
+
+	log.Error().
+		Err(err).
+		Str("domain", r.Host).
+		Str("path", r.URL.Path).
+		Int("status", status).
+		Msg("failed to proxy the request")
+
+	rule.Error(w, r, status, message)
+}
+
+func newRequestID() string {
+	return fmt.Sprintf("%016x%016x", rand.Uint64(), rand.Uint64())
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	domain := r.Host
 	path := r.URL.Path
 
-	log.Debug().Str("domain", domain).Str("path", path).Msg("a request received")
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+		r.Header.Set(RequestIDHeader, requestID)
+	}
+	w.Header().Set(RequestIDHeader, requestID)
 
-	container, endpoint, ok := s.domains.Paths(domain, false).Service(path, false).Select()
+	// clients can't opt out of Mirror
+	if !rule.IsMirrored(r.Context()) {
+		r.Header.Del(rule.MirrorHeader)
+	}
+
+	log.Debug().
+		Str("domain", domain).
+		Str("path", path).
+		Str("request_id", requestID).
+		Msg("a request received")
+
+	_, maintenance := s.maintenance.Get(domain)
+
+	// the rest of the info is set once the request is routed
+	info := &rule.RequestInfo{
+		RequestID:   requestID,
+		Domain:      domain,
+		Maintenance: maintenance,
+	}
+
+	renderer := rule.DefaultErrorRenderer
+	if page, ok := s.errorPages.Get(domain); ok {
+		renderer = page.renderer
+	}
+
+	ctx := rule.WithRequestInfo(r.Context(), info)
+	ctx = rule.WithErrorRenderer(ctx, renderer)
+	r = r.WithContext(ctx)
+
+	upgrade := upgradeProtocol(r)
+
+	container, endpoint, params, ok := s.domains.Paths(domain, false).Route(r)
 	if !ok {
 		log.Debug().Str("domain", domain).Str("path", path).Msg("not found")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		w.Write([]byte(`{"error": "service is not available"}`))
+		if maintenance {
+			// the containers might be stopped during the maintenance
+			s.apply(http.HandlerFunc(serviceUnavailable), rule.DefaultMaintenance()).ServeHTTP(w, r)
+			return
+		}
+		serviceUnavailable(w, r)
+		return
+	}
+
+	if upgrade != "" && !endpoint.Upgrade.allows(upgrade) {
+		rule.Error(w, r, http.StatusBadRequest, fmt.Sprintf("upgrade to %s is not allowed", upgrade))
 		return
 	}
 
+	if split := s.domains.Endpoint(endpoint, false).Split(); split != nil && split.Cookie != "" && endpoint.Version != "" {
+		if cookie, err := r.Cookie(split.Cookie); err != nil || cookie.Value != endpoint.Version {
+			http.SetCookie(w, &http.Cookie{
+				Name:     split.Cookie,
+				Value:    endpoint.Version,
+				Path:     "/",
+				HttpOnly: true,
+			})
+		}
+	}
+
+	log.Debug().
+		Str("domain", domain).
+		Str("path", path).
+		Str("version", endpoint.Version).
+		Msg("selected version")
+
 	proxy := &httputil.ReverseProxy{
 		Rewrite: func(r *httputil.ProxyRequest) {
 			url := &url.URL{
@@ -256,26 +975,62 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 			r.SetURL(url)     // Forward request to outboundURL.
 			r.SetXForwarded() // Set X-Forwarded-* headers.
+
+			if endpoint.ParamHeaderPrefix != "" {
+				for name, value := range params {
+					r.Out.Header.Set(endpoint.ParamHeaderPrefix+name, value)
+				}
+			}
 		},
+		ErrorHandler: proxyErrorHandler,
+	}
+
+	if endpoint.HTTP2 || rule.IsGRPC(r) {
+		proxy.Transport = s.h2c
 	}
 
 	rules, err := s.getMiddlewares(endpoint)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(struct {
-			Error string `json:"error"`
-		}{
-			Error: err.Error(),
-		})
+		log.Error().
+			Err(err).
+			Str("domain", domain).
+			Str("path", path).
+			Msg("failed to build rules")
+		rule.Error(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	if maintenance && !endpoint.hasRule(rule.MaintenanceName) {
+		rules = append([]rule.Middleware{rule.DefaultMaintenance()}, rules...)
+	}
+
 	log.
 		Debug().
 		Str("domain", domain).
 		Str("path", path).
 		Str("container_id", container.ID).
 		Msg("routing to the container")
+
+	info.Domain = endpoint.Domain
+	info.Path = endpoint.Path
+	info.ContainerID = container.ID
+	info.Upgrade = upgrade
+
+	container.active.Add(1)
+	defer container.active.Add(-1)
+
+	if upgrade != "" {
+		w = &upgradeWriter{
+			ResponseWriter: w,
+			container:      container,
+			upgrade:        endpoint.Upgrade,
+		}
+	}
+
+	ctx = rule.WithParams(r.Context(), map[string]string(params))
+	ctx = rule.WithRouter(ctx, s)
+
+	r = r.WithContext(ctx)
 	s.apply(proxy, rules...).ServeHTTP(w, r)
 }
 
@@ -287,35 +1042,77 @@ func (s *Server) getMiddlewares(endpoint *Endpoint) ([]rule.Middleware, error) {
 	middlewares := make([]rule.Middleware, 0)
 
 	for _, r := range endpoint.Rules {
-		builder, ok := s.rules[r.Type]
-		if !ok {
-			return nil, fmt.Errorf("failed to find rule builder for %s", r.Type)
-		}
-
-		middleware, err := builder(r.Args)
+		middleware, err := s.getMiddleware(endpoint, r)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse args for rule %s: %w", r.Type, err)
+			return nil, err
 		}
 
-		if middleware.IsCachable() {
-			log.
-				Debug().
-				Str("domain", endpoint.Domain).
-				Str("path", endpoint.Path).
-				Msg("using cached middleware")
-			middleware = s.middlewareCacheMap.GetAndUpdate(endpoint.getHashKey(), func(old rule.Middleware, found bool) rule.Middleware {
-				if found {
-					return old.UpdateMiddelware(middleware)
-				}
+		middlewares = append(middlewares, middleware)
+	}
 
-				return middleware.UpdateMiddelware(nil)
-			})
+	return middlewares, nil
+}
+
+func (s *Server) getMiddleware(endpoint *Endpoint, r Rule) (rule.Middleware, error) {
+	builder, ok := s.rules[r.Type]
+	if !ok {
+		return nil, fmt.Errorf("failed to find rule builder for %s", r.Type)
+	}
+
+	middleware, err := builder(r.Args)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse args for rule %s: %w", r.Type, err)
+	}
+
+	if middleware.IsCachable() {
+		log.
+			Debug().
+			Str("domain", endpoint.Domain).
+			Str("path", endpoint.Path).
+			Msg("using cached middleware")
+		middleware = s.middlewareCacheMap.GetAndUpdate(endpoint.getMiddlewareKey(r.Type), func(old rule.Middleware, found bool) rule.Middleware {
+			if found {
+				return old.UpdateMiddelware(middleware)
+			}
+
+			return middleware.UpdateMiddelware(nil)
+		})
+	}
+
+	return middleware, nil
+}
+
+// errorPage is the renderer of the errors of a domain, and the container declaring it
+type errorPage struct {
+	containerID string
+	renderer    rule.ErrorRenderer
+}
+
+// errorRenderer returns the ErrorPages rule of endpoint, it is built by the
+// pinger, so requests only look it up
+func (s *Server) errorRenderer(endpoint *Endpoint) (rule.ErrorRenderer, bool) {
+	for _, r := range endpoint.Rules {
+		if r.Type != rule.ErrorPagesName {
+			continue
 		}
 
-		middlewares = append(middlewares, middleware)
+		middleware, err := s.getMiddleware(endpoint, r)
+		if err != nil {
+			return nil, false
+		}
+
+		renderer, ok := middleware.(rule.ErrorRenderer)
+		return renderer, ok
 	}
 
-	return middlewares, nil
+	return nil, false
+}
+
+// removeErrorPage removes the error page of domain, if containerID declares it
+func (s *Server) removeErrorPage(domain string, containerID string) {
+	if page, ok := s.errorPages.Get(domain); ok && page.containerID == containerID {
+		s.errorPages.Delete(domain)
+	}
 }
 
 func (s *Server) apply(next http.Handler, rules ...rule.Middleware) http.Handler {
@@ -327,9 +1124,14 @@ func (s *Server) apply(next http.Handler, rules ...rule.Middleware) http.Handler
 }
 
 type bakerOption struct {
-	rules         map[string]rule.BuilderFunc
-	pingDuration  time.Duration
-	onAfterPinger func(containerSet *collection.Set[string, *Container])
+	rules          map[string]rule.BuilderFunc
+	pingDuration   time.Duration
+	regexFirst     bool
+	drainTimeout   time.Duration
+	maxUDPSessions int
+	certStore      *certstore.Store
+	onNewDomain    func(domain string)
+	onAfterPinger  func(containerSet *collection.Set[string, *Container])
 }
 
 type bakerOptionFunc func(*bakerOption)
@@ -348,6 +1150,46 @@ func WithRules(rules ...rule.RegisterFunc) bakerOptionFunc {
 	}
 }
 
+// WithRegexFirst evaluates regex paths before trie paths
+func WithRegexFirst() bakerOptionFunc {
+	return func(o *bakerOption) {
+		o.regexFirst = true
+	}
+}
+
+// WithDrainTimeout sets how long the upgraded connections of a removed
+// container are kept open, so they can be closed gracefully by either side
+func WithDrainTimeout(d time.Duration) bakerOptionFunc {
+	return func(o *bakerOption) {
+		o.drainTimeout = d
+	}
+}
+
+// WithMaxUDPSessions sets how many sessions each ServeUDP keeps at most,
+// 10000 by default
+func WithMaxUDPSessions(n int) bakerOptionFunc {
+	return func(o *bakerOption) {
+		o.maxUDPSessions = n
+	}
+}
+
+// WithCertStore loads the certificates of the endpoints into store, so
+// they can be served using store.GetCertificate
+func WithCertStore(store *certstore.Store) bakerOptionFunc {
+	return func(o *bakerOption) {
+		o.certStore = store
+	}
+}
+
+// WithOnNewDomain calls onNewDomain each time a domain without any container
+// gets one, e.g. to issue its certificate before the first request. It is
+// called by the pinger, so it should not block.
+func WithOnNewDomain(onNewDomain func(domain string)) bakerOptionFunc {
+	return func(o *bakerOption) {
+		o.onNewDomain = onNewDomain
+	}
+}
+
 func WithOnAfterPinger(onAfterPinger func(containerSet *collection.Set[string, *Container])) bakerOptionFunc {
 	return func(o *bakerOption) {
 		o.onAfterPinger = onAfterPinger
@@ -356,23 +1198,39 @@ func WithOnAfterPinger(onAfterPinger func(containerSet *collection.Set[string, *
 
 func New(containers <-chan *Container, optFuncs ...bakerOptionFunc) *Server {
 	opt := &bakerOption{
-		rules:        make(map[string]rule.BuilderFunc),
-		pingDuration: 10 * time.Second,
+		rules:          make(map[string]rule.BuilderFunc),
+		pingDuration:   10 * time.Second,
+		drainTimeout:   30 * time.Second,
+		maxUDPSessions: defaultMaxUDPSessions,
 	}
 
 	for _, optFunc := range optFuncs {
 		optFunc(opt)
 	}
 
+	domains := NewDomains()
+	domains.regexFirst = opt.regexFirst
+
+	h2c := httpclient.H2C()
+
 	s := &Server{
-		domains:            NewDomains(),
+		domains:            domains,
+		layer4:             collection.NewMap[*Service](),
 		rules:              opt.rules,
 		pingDuration:       opt.pingDuration,
 		containers:         collection.NewSet[string, *Container](),
 		done:               make(chan struct{}, 1),
 		http:               httpclient.New(),
-		refMap:             collection.NewMap[*value](),
+		h2c:                h2c,
+		healthClient:       &http.Client{Transport: h2c, Timeout: 3 * time.Second},
+		refMap:             collection.NewMap[[]*value](),
 		middlewareCacheMap: collection.NewMap[rule.Middleware](),
+		maintenance:        collection.NewMap[bool](),
+		errorPages:         collection.NewMap[errorPage](),
+		drainTimeout:       opt.drainTimeout,
+		maxUDPSessions:     opt.maxUDPSessions,
+		certStore:          opt.certStore,
+		onNewDomain:        opt.onNewDomain,
 		onAfterPinger:      opt.onAfterPinger,
 	}
 
@@ -388,33 +1246,45 @@ func New(containers <-chan *Container, optFuncs ...bakerOptionFunc) *Server {
 					s.containers.Put(container.ID, container)
 				} else {
 					log.Debug().Str("container_id", container.ID).Msg("removing from the container list")
+					if removed, ok := s.containers.Get(container.ID); ok {
+						go s.drain(removed, s.drainTimeout)
+					}
 					s.containers.Remove(container.ID)
 
-					value, ok := s.refMap.Get(container.ID)
+					values, ok := s.refMap.Get(container.ID)
 					if !ok {
 						log.
 							Error().
 							Str("container_id", container.ID).
 							Msg("failed to find container in refMap")
-						return
+						continue
 					}
 
 					s.refMap.Delete(container.ID)
 
-					remaining := s.domains.
-						Paths(value.endpoint.Domain, false).
-						Service(value.endpoint.Path, false).
-						Remove(value.container)
-
-					// NOTE: if there is no more containers for this endpoint
-					// we can remove the middleware from the cache
-					if remaining == 0 {
-						log.
-							Debug().
-							Str("domain", value.endpoint.Domain).
-							Str("path", value.endpoint.Path).
-							Msg("removing middleware from cache")
-						s.middlewareCacheMap.Delete(value.endpoint.getHashKey())
+					for _, value := range values {
+						s.removeErrorPage(value.endpoint.Domain, container.ID)
+
+						remaining := s.
+							service(value.endpoint, false).
+							Remove(value.container)
+
+						// NOTE: if there is no more containers for this endpoint
+						// we can remove the middleware from the cache
+						if remaining == 0 {
+							log.
+								Debug().
+								Str("domain", value.endpoint.Domain).
+								Str("path", value.endpoint.Path).
+								Msg("removing middleware from cache")
+							for _, r := range value.endpoint.Rules {
+								s.middlewareCacheMap.Delete(value.endpoint.getMiddlewareKey(r.Type))
+							}
+						}
+
+						if value.endpoint.Certificate != nil {
+							s.unassignCertificate(value.endpoint.Domain)
+						}
 					}
 				}
 			}
@@ -1,16 +1,29 @@
 package baker_test
 
 import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alinz/baker.go"
 	"github.com/alinz/baker.go/confutil"
+	"github.com/alinz/baker.go/pkg/httpclient"
 	"github.com/alinz/baker.go/rule"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestDomains(t *testing.T) {
@@ -48,6 +61,214 @@ func TestDomains(t *testing.T) {
 	}
 }
 
+func TestServiceRoute(t *testing.T) {
+	domains := baker.NewDomains()
+
+	endpointDefault := &baker.Endpoint{
+		Domain: "example.com",
+		Path:   "/api/*",
+		Ready:  true,
+	}
+
+	endpointGRPC := &baker.Endpoint{
+		Domain: "example.com",
+		Path:   "/api/*",
+		Ready:  true,
+		Match: &baker.Match{
+			Headers: []baker.Condition{{Name: "Content-Type", Value: "application/grpc"}},
+		},
+	}
+
+	endpointBeta := &baker.Endpoint{
+		Domain: "example.com",
+		Path:   "/api/*",
+		Ready:  true,
+		Match: &baker.Match{
+			Methods:  []string{"GET"},
+			Cookies:  []baker.Condition{{Name: "cohort"}},
+			Priority: 10,
+		},
+	}
+
+	container1 := &baker.Container{ID: "1"}
+	container2 := &baker.Container{ID: "2"}
+	container3 := &baker.Container{ID: "3"}
+
+	domains.Paths("example.com", true).Service("/api/*", true).Add(container1, endpointDefault)
+	domains.Paths("example.com", true).Service("/api/*", true).Add(container2, endpointGRPC)
+	domains.Paths("example.com", true).Service("/api/*", true).Add(container3, endpointBeta)
+
+	service, _ := domains.Paths("example.com", false).Match("/api/users")
+
+	req := httptest.NewRequest("POST", "/api/users", nil)
+	container, _, ok := service.Route(req)
+	assert.True(t, ok)
+	assert.Equal(t, container1, container)
+
+	req = httptest.NewRequest("POST", "/api/users", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	container, _, ok = service.Route(req)
+	assert.True(t, ok)
+	assert.Equal(t, container2, container)
+
+	req = httptest.NewRequest("GET", "/api/users", nil)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.AddCookie(&http.Cookie{Name: "cohort", Value: "beta"})
+	container, _, ok = service.Route(req)
+	assert.True(t, ok)
+	assert.Equal(t, container3, container)
+
+	assert.Equal(t, 2, service.Remove(container3))
+}
+
+func TestRegexPaths(t *testing.T) {
+	domains := baker.NewDomains()
+
+	endpointTrie := &baker.Endpoint{
+		Domain: "example.com",
+		Path:   "/files/index.html",
+		Ready:  true,
+	}
+
+	endpointRegex := &baker.Endpoint{
+		Domain:   "example.com",
+		Path:     `/files/(?P<name>[0-9]+)\.pdf`,
+		PathType: baker.PathTypeRegex,
+		Ready:    true,
+	}
+
+	container1 := &baker.Container{ID: "1"}
+	container2 := &baker.Container{ID: "2"}
+
+	domains.Endpoint(endpointTrie, true).Add(container1, endpointTrie)
+	domains.Endpoint(endpointRegex, true).Add(container2, endpointRegex)
+
+	paths := domains.Paths("example.com", false)
+
+	container, _, _, ok := paths.Route(httptest.NewRequest("GET", "/files/index.html", nil))
+	assert.True(t, ok)
+	assert.Equal(t, container1, container)
+
+	container, _, params, ok := paths.Route(httptest.NewRequest("GET", "/files/123.pdf", nil))
+	assert.True(t, ok)
+	assert.Equal(t, container2, container)
+	assert.Equal(t, "123", params["name"])
+
+	_, _, _, ok = paths.Route(httptest.NewRequest("GET", "/files/123.pdf/other", nil))
+	assert.False(t, ok)
+}
+
+func TestPathParams(t *testing.T) {
+	type received struct {
+		path   string
+		header http.Header
+	}
+	requests := make(chan received, 1)
+
+	config := confutil.NewEndpoints().
+		New("example.com", "/users/:id/*rest", true).
+		WithParamHeaderPrefix("X-Param-").
+		WithRules(
+			rule.NewReplacePath("/users", "/v2/users/{id}", 1),
+			rule.NewHeaders(rule.HeaderOps{Set: map[string]string{"X-User": "user-{id}"}}, rule.HeaderOps{}),
+		)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/config" {
+			config.WriteResponse(w)
+			return
+		}
+		requests <- received{path: r.URL.Path, header: r.Header.Clone()}
+	}))
+	t.Cleanup(upstream.Close)
+
+	containers := make(chan *baker.Container, 1)
+	containers <- &baker.Container{
+		ID:   "container-0",
+		Addr: netip.MustParseAddrPort(upstream.Listener.Addr().String()),
+		Path: "/config",
+	}
+
+	url := StartBakerServer(t, containers, 1)
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/users/42/posts/7", url), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "example.com"
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	result := <-requests
+	assert.Equal(t, "42", result.header.Get("X-Param-Id"))
+	assert.Equal(t, "posts/7", result.header.Get("X-Param-Rest"))
+	assert.Equal(t, "user-42", result.header.Get("X-User"))
+	assert.Equal(t, "/v2/users/42/42/posts/7", result.path)
+}
+
+func TestServiceSplit(t *testing.T) {
+	domains := baker.NewDomains()
+
+	split := &baker.Split{
+		Weights: map[string]int{"v1": 95, "v2": 5},
+		Header:  "X-User",
+	}
+
+	endpointV1 := &baker.Endpoint{
+		Domain:  "example.com",
+		Path:    "/*",
+		Version: "v1",
+		Split:   split,
+	}
+
+	endpointV2 := &baker.Endpoint{
+		Domain:  "example.com",
+		Path:    "/*",
+		Version: "v2",
+	}
+
+	service := domains.Endpoint(endpointV1, true)
+	service.Add(&baker.Container{ID: "1"}, endpointV1)
+	service.Add(&baker.Container{ID: "2"}, endpointV2)
+
+	assert.Equal(t, split, service.Split())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User", "alice")
+
+	_, first, ok := service.Route(req)
+	assert.True(t, ok)
+
+	for i := 0; i < 100; i++ {
+		_, endpoint, ok := service.Route(req)
+		assert.True(t, ok)
+		assert.Equal(t, first.Version, endpoint.Version)
+	}
+
+	assert.Equal(t, uint64(101), service.Requests()[first.Version])
+
+	split.Weights = map[string]int{"v2": 1}
+
+	_, endpoint, ok := service.Route(httptest.NewRequest("GET", "/", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "v2", endpoint.Version)
+
+	// the split goes away with the config or the container declaring it
+	service.Add(&baker.Container{ID: "1"}, &baker.Endpoint{Domain: "example.com", Path: "/*", Version: "v1"})
+	assert.Nil(t, service.Split())
+
+	service.Add(&baker.Container{ID: "1"}, endpointV1)
+	assert.Equal(t, split, service.Split())
+
+	service.Remove(&baker.Container{ID: "1"})
+	assert.Nil(t, service.Split())
+}
+
 func TestBasicBaker(t *testing.T) {
 	configs := []interface {
 		WriteResponse(w http.ResponseWriter)
@@ -91,10 +312,15 @@ func TestBasicBaker(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		result, _ := io.ReadAll(resp.Body)
+		var result struct {
+			Error     string `json:"error"`
+			RequestID string `json:"request_id"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
 
 		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
-		assert.Equal(t, `{"error": "service is not available"}`, string(result))
+		assert.Equal(t, "service is not available", result.Error)
+		assert.Equal(t, resp.Header.Get(baker.RequestIDHeader), result.RequestID)
 	})
 
 	t.Run("testing RateLimiting", func(t *testing.T) {
@@ -133,3 +359,1045 @@ func TestBasicBaker(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 }
+
+func TestHasDomain(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/*", true).
+			NewTCP(5432, 5432),
+	}
+	containers := MockDriver(t, configs...)
+
+	server, _ := StartBaker(t, containers, len(configs))
+
+	assert.True(t, server.HasDomain("example.com"))
+	assert.False(t, server.HasDomain("attacker.com"))
+}
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan string, 1)
+
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r.URL.Path + ":" + string(body)
+	}))
+	t.Cleanup(shadow.Close)
+
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().New("example.com", "/users/:id", true).WithRules(
+			rule.NewMirror(100, "", shadow.Listener.Addr().String(), "/v2/users/{id}"),
+		),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/users/42", url), strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Host = "example.com"
+	// clients can't opt out of mirroring
+	req.Header.Set(rule.MirrorHeader, "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	select {
+	case result := <-mirrored:
+		assert.Equal(t, "/v2/users/42:hello", result)
+	case <-time.After(2 * time.Second):
+		t.Fatal("request was not mirrored")
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().New("example.com", "/*", true).WithRules(
+			rule.NewHeaders(
+				rule.HeaderOps{},
+				rule.HeaderOps{
+					Set:    map[string]string{"Strict-Transport-Security": "max-age=63072000", "X-Served-By": "{container_id}"},
+					Rename: map[string]string{baker.RequestIDHeader: "X-Trace-Id"},
+				},
+			),
+		),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/", url), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Host = "example.com"
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "max-age=63072000", resp.Header.Get("Strict-Transport-Security"))
+	assert.Equal(t, "container-0", resp.Header.Get("X-Served-By"))
+	assert.Equal(t, "", resp.Header.Get(baker.RequestIDHeader))
+	assert.NotEmpty(t, resp.Header.Get("X-Trace-Id"))
+}
+
+func TestCORS(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().New("example.com", "/*", true).WithRules(
+			rule.NewCORS([]string{"https://*.example.com"}, []string{"GET", "PUT"}, []string{"*"}, true),
+		),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	t.Run("preflight of an allowed origin", func(t *testing.T) {
+		req, err := http.NewRequest("OPTIONS", fmt.Sprintf("%s/", url), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "PUT")
+		req.Header.Set("Access-Control-Request-Headers", "X-Custom")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "GET, PUT", resp.Header.Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "X-Custom", resp.Header.Get("Access-Control-Allow-Headers"))
+		assert.Equal(t, "true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	})
+
+	t.Run("request of a disallowed origin", func(t *testing.T) {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/", url), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		req.Header.Set("Origin", "https://example.org")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("reader:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/basic", true).
+			WithRules(
+				rule.NewBasicAuth(map[string]string{"admin": string(hash)}, "admin"),
+			).
+			New("example.com", "/htpasswd", true).
+			WithRules(struct {
+				Type string `json:"type"`
+				Args any    `json:"args"`
+			}{
+				Type: rule.BasicAuthName,
+				Args: &rule.BasicAuth{HtpasswdFile: htpasswd},
+			}).
+			New("example.com", "/key", true).
+			WithRules(
+				rule.NewAPIKey(map[string]string{"billing": "secret"}, ""),
+			),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	do := func(path string, setup func(req *http.Request)) *http.Response {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", url, path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		setup(req)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	resp := do("/basic", func(req *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, `Basic realm="admin", charset="UTF-8"`, resp.Header.Get("WWW-Authenticate"))
+
+	resp = do("/basic", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = do("/basic", func(req *http.Request) { req.SetBasicAuth("admin", "password") })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do("/htpasswd", func(req *http.Request) { req.SetBasicAuth("reader", "password") })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the users removed from the htpasswd file are rejected once it is reloaded
+	os.WriteFile(htpasswd, []byte("writer:"+string(hash)+"\n"), 0o600)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(htpasswd, later, later)
+
+	assert.Eventually(t, func() bool {
+		resp := do("/htpasswd", func(req *http.Request) { req.SetBasicAuth("reader", "password") })
+		return resp.StatusCode == http.StatusUnauthorized
+	}, 5*time.Second, 100*time.Millisecond)
+
+	resp = do("/htpasswd", func(req *http.Request) { req.SetBasicAuth("writer", "password") })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do("/key", func(req *http.Request) { req.Header.Set("X-API-Key", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = do("/key", func(req *http.Request) { req.Header.Set("X-API-Key", "secret") })
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestForwardAuth(t *testing.T) {
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.Header().Set("Location", "https://sso.example.com/login")
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+
+		assert.Equal(t, "/private", r.Header.Get("X-Forwarded-Uri"))
+		w.Header().Set("X-User-Id", "42")
+	}))
+	t.Cleanup(auth.Close)
+
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().New("example.com", "/*", true).WithRules(
+			rule.NewForwardAuth(auth.URL+"/verify", "", "", []string{"X-User-Id"}),
+		),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	httpClient := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/private", url), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Host = "example.com"
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "https://sso.example.com/login", resp.Header.Get("Location"))
+
+	req.Header.Set("Authorization", "Bearer good")
+
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestIPFilter(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/admin", true).
+			WithRules(
+				rule.NewIPFilter([]string{"10.8.0.0/16"}, nil, nil),
+			).
+			New("example.com", "/public", true).
+			WithRules(
+				rule.NewIPFilter(nil, []string{"10.8.0.0/16"}, []string{"127.0.0.1"}),
+			),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	do := func(path string, xff string) int {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", url, path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp.StatusCode
+	}
+
+	// the proxy headers are not trusted, the client is 127.0.0.1
+	assert.Equal(t, http.StatusForbidden, do("/admin", "10.8.0.1"))
+	assert.Equal(t, http.StatusOK, do("/public", ""))
+	assert.Equal(t, http.StatusForbidden, do("/public", "10.8.0.1"))
+}
+
+func TestCompress(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/", true).
+			WithRules(
+				rule.NewCompress([]string{rule.EncodingGzip}, nil, 1),
+			),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	do := func(headers map[string]string) *http.Response {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		return resp
+	}
+
+	resp := do(map[string]string{"Accept-Encoding": "br;q=1, gzip;q=0.5"})
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+
+	reader, err := gzip.NewReader(resp.Body)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(body))
+
+	resp = do(map[string]string{"Accept-Encoding": "gzip;q=0"})
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+
+	resp = do(map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-1"})
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+}
+
+func TestCache(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/a", true).
+			WithRules(
+				rule.NewCache(1<<20, time.Minute, 0),
+			),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	do := func(path string, headers map[string]string) *http.Response {
+		req, err := http.NewRequest("GET", url+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		return resp
+	}
+
+	resp := do("/a?x=1", nil)
+	assert.Equal(t, "MISS", resp.Header.Get(rule.CacheStatusHeader))
+
+	resp = do("/a?x=1", nil)
+	assert.Equal(t, "HIT", resp.Header.Get(rule.CacheStatusHeader))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "{}", string(body))
+
+	resp = do("/a?x=2", nil)
+	assert.Equal(t, "MISS", resp.Header.Get(rule.CacheStatusHeader))
+
+	resp = do("/a?x=1", map[string]string{"Cache-Control": "no-store"})
+	assert.Equal(t, "BYPASS", resp.Header.Get(rule.CacheStatusHeader))
+
+	// responses which are neither public nor vary on Cookie are
+	// not shared with the requests which have cookies
+	resp = do("/a?x=1", map[string]string{"Cookie": "session=1"})
+	assert.Equal(t, "MISS", resp.Header.Get(rule.CacheStatusHeader))
+
+	resp = do("/a?x=3", map[string]string{"Cookie": "session=1"})
+	assert.Equal(t, "MISS", resp.Header.Get(rule.CacheStatusHeader))
+
+	resp = do("/a?x=3", nil)
+	assert.Equal(t, "MISS", resp.Header.Get(rule.CacheStatusHeader))
+}
+
+func TestLimits(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/upload", true).
+			WithRules(
+				rule.NewLimits(16, 0, 0, 0),
+			).
+			New("example.com", "/api", true).
+			WithRules(
+				rule.NewLimits(0, 512, 100*time.Millisecond, 0),
+			),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	do := func(method string, path string, body io.Reader, headers map[string]string) int {
+		req, err := http.NewRequest(method, url+path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, do("POST", "/upload", strings.NewReader("small"), nil))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, do("POST", "/upload", strings.NewReader(strings.Repeat("a", 32)), nil))
+	// without a Content-Length, the limit is enforced while the body is sent to the container
+	assert.Equal(t, http.StatusRequestEntityTooLarge, do("POST", "/upload", io.MultiReader(strings.NewReader(strings.Repeat("a", 32))), nil))
+
+	assert.Equal(t, http.StatusOK, do("GET", "/api?sleep=10ms", nil, nil))
+	assert.Equal(t, http.StatusGatewayTimeout, do("GET", "/api?sleep=500ms", nil, nil))
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, do("GET", "/api", nil, map[string]string{"X-Large": strings.Repeat("a", 1024)}))
+}
+
+func TestRedirectRewrite(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/blog/*", true).
+			WithRules(
+				rule.NewRedirect(http.StatusMovedPermanently, "https", "new.example.com", `^/blog/(?P<year>\d{4})/(.*)$`, "/posts/${year}/$2"),
+			).
+			New("example.com", "/old/*", true).
+			WithRules(
+				rule.NewRedirect(http.StatusSeeOther, "", "", `^/old(/.*)$`, "$1"),
+			).
+			New("example.com", "/api/v1/*", true).
+			WithRules(
+				rule.NewRewrite(`^/api/v1/(.*)$`, "/$1?version=1"),
+			),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	do := func(path string) *http.Response {
+		req, err := http.NewRequest("GET", url+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		return resp
+	}
+
+	resp := do("/blog/2023/hello?ref=rss")
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "https://new.example.com/posts/2023/hello?ref=rss", resp.Header.Get("Location"))
+
+	// the location never points to another site
+	resp = do("/old//evil.com/x")
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/evil.com/x", resp.Header.Get("Location"))
+
+	// the path doesn't match, so the request is sent to the container
+	resp = do("/blog/about")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do("/api/v1/users?limit=10")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	path, query, _ := strings.Cut(resp.Header.Get("X-Upstream-Uri"), "?")
+	assert.Equal(t, "/users", path)
+	assert.ElementsMatch(t, []string{"version=1", "limit=10"}, strings.Split(query, "&"))
+}
+
+func TestRespondMaintenance(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/robots.txt", true).
+			WithRules(
+				rule.NewRespond(http.StatusOK, map[string]string{"Content-Type": "text/plain"}, "request {request_id}"),
+			).
+			New("example.com", "/app", true).
+			WithRules(
+				rule.NewMaintenance(false, "down", "text/plain", nil),
+			).
+			New("example.com", "/health", true).
+			New("example.com", "/healthcare", true),
+	}
+	containers := MockDriver(t, configs...)
+
+	server, url := StartBaker(t, containers, len(configs))
+
+	do := func(path string) (int, string) {
+		req, err := http.NewRequest("GET", url+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		req.Header.Set(baker.RequestIDHeader, "42")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := do("/robots.txt")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "request 42", body)
+
+	status, _ = do("/app")
+	assert.Equal(t, http.StatusOK, status)
+
+	server.SetMaintenance("example.com", true)
+
+	status, body = do("/app")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "down", body)
+
+	// health checks keep passing
+	status, _ = do("/health")
+	assert.Equal(t, http.StatusOK, status)
+
+	// but not the paths which only start like them
+	status, _ = do("/healthcare")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	status, body = do("/unknown")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, `{"error":"service is under maintenance","request_id":"42"}`, body)
+
+	server.SetMaintenance("example.com", false)
+
+	status, _ = do("/app")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestErrorPages(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/app", true).
+			WithRules(
+				rule.NewErrorPages(
+					`<h1>{{.StatusCode}}</h1><p>{{.RequestID}}</p>`,
+					`{"code": {{.StatusCode}}, "message": {{json .Message}}, "id": {{json .RequestID}}}`,
+					true,
+				),
+				rule.NewIPFilter(nil, []string{"10.0.0.0/8"}, []string{"127.0.0.1"}),
+			),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	do := func(path string, headers map[string]string) (int, string) {
+		req, err := http.NewRequest("GET", url+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		req.Header.Set(baker.RequestIDHeader, "42")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// the response of the container is replaced
+	status, body := do("/app?status=500", nil)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, `{"code": 500, "message": "internal server error", "id": "42"}`, body)
+
+	status, body = do("/app?status=502", map[string]string{"Accept": "text/html"})
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, `<h1>502</h1><p>42</p>`, body)
+
+	status, _ = do("/app?status=404", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// errors of the rules use the same pages
+	status, body = do("/app", map[string]string{"X-Forwarded-For": "10.0.0.1"})
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, `{"code": 403, "message": "forbidden", "id": "42"}`, body)
+
+	// so do the errors of the domain which are not routed to a container
+	status, body = do("/unknown", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, `{"code": 503, "message": "service is not available", "id": "42"}`, body)
+}
+
+func TestErrorPagesRemoved(t *testing.T) {
+	config := confutil.NewEndpoints().
+		New("example.com", "/app", true).
+		WithRules(rule.NewErrorPages("", `{"code": {{.StatusCode}}}`, false))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config.WriteResponse(w)
+	}))
+	t.Cleanup(upstream.Close)
+
+	containers := make(chan *baker.Container, 2)
+	containers <- &baker.Container{
+		ID:   "container-0",
+		Addr: netip.MustParseAddrPort(upstream.Listener.Addr().String()),
+		Path: "/config",
+	}
+
+	url := StartBakerServer(t, containers, 1)
+
+	do := func() string {
+		req, err := http.NewRequest("GET", url+"/unknown", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "example.com"
+		req.Header.Set(baker.RequestIDHeader, "42")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert.Equal(t, `{"code": 503}`, do())
+
+	// the pages of the domain go away with the container declaring them
+	containers <- &baker.Container{ID: "container-0"}
+
+	assert.Eventually(t, func() bool {
+		return do() == `{"error":"service is not available","request_id":"42"}`
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestUpgrade(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/ws", true).
+			WithBalance(baker.BalanceLeastConn).
+			WithUpgrade(map[string]any{
+				"protocols":    []string{"websocket"},
+				"idle_timeout": "300ms",
+			}).
+			New("example.com", "/no-ws", true).
+			WithUpgrade(map[string]any{"disabled": true}),
+	}
+	containers := MockDriver(t, configs...)
+
+	server, url := StartBaker(t, containers, len(configs))
+
+	dial := func(path string, protocol string) (net.Conn, *bufio.Reader, int) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", path, protocol)
+
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return conn, reader, resp.StatusCode
+	}
+
+	routes := func() string {
+		rec := httptest.NewRecorder()
+		server.Admin().ServeHTTP(rec, httptest.NewRequest("GET", "/routes", nil))
+		return rec.Body.String()
+	}
+
+	_, _, status := dial("/no-ws", "websocket")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	_, _, status = dial("/ws", "h2c")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	conn, reader, status := dial("/ws", "websocket")
+	assert.Equal(t, http.StatusSwitchingProtocols, status)
+
+	fmt.Fprint(conn, "hello")
+	echo := make([]byte, 5)
+	_, err := io.ReadFull(reader, echo)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(echo))
+
+	assert.Contains(t, routes(), `"active_connections":1,"upgraded_connections":1`)
+
+	// the connection is closed once idle
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(routes(), `"active_connections":0,"upgraded_connections":0`)
+	}, time.Second, 10*time.Millisecond)
+
+	// a draining container doesn't receive new requests
+	assert.True(t, server.SetDraining("container-0", true))
+	_, _, status = dial("/ws", "websocket")
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+}
+
+func TestGRPC(t *testing.T) {
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			New("example.com", "/echo.Echo/Say", true).
+			WithHealthCheck(map[string]any{"type": "grpc"}).
+			New("example.com", "/echo.Echo/Down", true).
+			WithHealthCheck(map[string]any{"type": "grpc", "service": "down"}),
+	}
+	containers := MockDriver(t, configs...)
+
+	url := StartBakerServer(t, containers, len(configs))
+
+	client := &http.Client{Transport: httpclient.H2C()}
+
+	call := func(path string) (*http.Response, string) {
+		req, err := http.NewRequest("POST", url+path, strings.NewReader("\x00\x00\x00\x00\x02hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Host = "example.com"
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("TE", "trailers")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	// HTTP/2 end to end, with the trailers of the container
+	resp, body := call("/echo.Echo/Say")
+	assert.Equal(t, 2, resp.ProtoMajor)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "\x00\x00\x00\x00\x02hi", body)
+	assert.Equal(t, "0", resp.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "HTTP/2.0", resp.Trailer.Get("X-Upstream-Proto"))
+
+	// the container is not serving, so the route is not available
+	resp, body = call("/echo.Echo/Down")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", body)
+	assert.Equal(t, "application/grpc", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "14", resp.Header.Get("Grpc-Status"))
+	assert.Equal(t, "service is not available", resp.Header.Get("Grpc-Message"))
+}
+
+func TestLayer4(t *testing.T) {
+	// a TCP echo server and a TLS server, both run by the container
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("passthrough"))
+	}))
+	t.Cleanup(tlsServer.Close)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := func(addr string) int {
+		_, port, _ := net.SplitHostPort(strings.TrimPrefix(addr, "https://"))
+		n, _ := strconv.Atoi(port)
+		return n
+	}
+
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().
+			NewTCP(port(tcpListener.Addr().String()), port(echo.Addr().String())).
+			NewSNI("*.db.example.com", port(tlsServer.URL)),
+	}
+	containers := MockDriver(t, configs...)
+
+	server, _ := StartBaker(t, containers, len(configs))
+
+	go server.ServeTCP(tcpListener)
+	t.Cleanup(func() { tcpListener.Close() })
+
+	conn, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, "hello")
+	conn.(*net.TCPConn).CloseWrite()
+	body, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+	conn.Close()
+
+	// TLS connections are passed through by SNI, the other ones are terminated by baker
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("terminated"))
+	}))
+	frontend.Listener = server.SNIListener(frontend.Listener)
+	frontend.StartTLS()
+	t.Cleanup(frontend.Close)
+
+	get := func(serverName string) string {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+			},
+		}
+
+		resp, err := client.Get(frontend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	assert.Equal(t, "passthrough", get("eu.db.example.com"))
+	assert.Equal(t, "terminated", get("example.com"))
+}
+
+func TestUDP(t *testing.T) {
+	// each container replies with its name and the datagram it received
+	echo := func(name string) int {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				conn.WriteTo([]byte(name+":"+string(buf[:n])), addr)
+			}
+		}()
+
+		return conn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.LocalAddr().(*net.UDPAddr).Port
+
+	configs := []interface {
+		WriteResponse(w http.ResponseWriter)
+	}{
+		confutil.NewEndpoints().NewUDP(port, echo("a")).WithIdleTimeout("300ms"),
+		confutil.NewEndpoints().NewUDP(port, echo("b")).WithIdleTimeout("300ms"),
+	}
+	containers := MockDriver(t, configs...)
+
+	server, _ := StartBaker(t, containers, len(configs))
+
+	go server.ServeUDP(listener)
+	t.Cleanup(func() { listener.Close() })
+
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	exchange := func(message string) string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		fmt.Fprint(conn, message)
+
+		buf := make([]byte, 1024)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	// the client sticks to the same container
+	first := exchange("1")
+	name, _, _ := strings.Cut(first, ":")
+	for i := 2; i <= 5; i++ {
+		assert.Equal(t, fmt.Sprintf("%s:%d", name, i), exchange(strconv.Itoa(i)))
+	}
+
+	routes := func() string {
+		rec := httptest.NewRecorder()
+		server.Admin().ServeHTTP(rec, httptest.NewRequest("GET", "/routes", nil))
+		return rec.Body.String()
+	}
+
+	assert.Contains(t, routes(), `"active_connections":1`)
+
+	// the session expires once idle
+	assert.Eventually(t, func() bool {
+		return !strings.Contains(routes(), `"active_connections":1`)
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// and the next datagram starts a new one
+	assert.True(t, strings.HasSuffix(exchange("6"), ":6"))
+}
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alinz/baker.go"
 	"github.com/alinz/baker.go/driver/docker"
 	"github.com/alinz/baker.go/pkg/acme"
+	"github.com/alinz/baker.go/pkg/certstore"
+	"github.com/alinz/baker.go/pkg/listener"
 	"github.com/alinz/baker.go/pkg/log"
+	"github.com/alinz/baker.go/pkg/rfc2136"
 	"github.com/alinz/baker.go/rule"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var Version = "master"
@@ -34,6 +43,16 @@ https://github.com/alinz/baker.go
 	acmePath := os.Getenv("BAKER_ACME_PATH")
 	acmeEnable := strings.ToLower(os.Getenv("BAKER_ACME")) == "yes"
 	logLevel := strings.ToLower(os.Getenv("BAKER_LOG_LEVEL"))
+	adminAddr := os.Getenv("BAKER_ADMIN_ADDR")
+	httpMode := strings.ToLower(os.Getenv("BAKER_HTTP_MODE"))
+	httpRedirectCode := os.Getenv("BAKER_HTTP_REDIRECT_CODE")
+	tcpPorts := os.Getenv("BAKER_TCP_PORTS")
+	udpPorts := os.Getenv("BAKER_UDP_PORTS")
+	sniAddr := os.Getenv("BAKER_SNI_ADDR")
+	http3Enable := strings.ToLower(os.Getenv("BAKER_HTTP3")) == "yes"
+	certsDir := os.Getenv("BAKER_CERTS_DIR")
+	acmeDomains := os.Getenv("BAKER_ACME_DOMAINS")
+	acmePreIssue := strings.ToLower(os.Getenv("BAKER_ACME_PRE_ISSUE")) == "yes"
 
 	log.Configure(log.Config{
 		ConsoleLoggingEnabled: true,
@@ -43,6 +62,11 @@ https://github.com/alinz/baker.go
 		Level:                 logLevel,
 	})
 
+	listenerConfig, err := listener.FromEnv(os.Getenv)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid listener config")
+	}
+
 	done := make(chan struct{}, 1)
 	defer close(done)
 
@@ -73,30 +97,303 @@ https://github.com/alinz/baker.go
 		}
 	}()
 
+	// the certificates of the directory and of the endpoints are
+	// served instead of the ones issued by ACME
+	certStore := certstore.New(certsDir)
+	if certsDir != "" {
+		if err := certStore.LoadDir(); err != nil {
+			log.Error().Err(err).Str("dir", certsDir).Msg("failed to load certificates")
+		}
+	}
+
+	go certStore.Watch(10*time.Second, certsDir != "", done, func(err error) {
+		log.Error().Err(err).Msg("failed to reload certificates")
+	})
+
 	containers, err := docker.New()
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create docker driver")
 	}
 
+	// the domains which appear in the configs of the containers, their
+	// certificates are issued right away if BAKER_ACME_PRE_ISSUE is set
+	newDomains := make(chan string, 100)
+
 	baker := baker.New(
 		containers,
 		baker.WithPingDuration(10*time.Second),
+		baker.WithCertStore(certStore),
+		baker.WithOnNewDomain(func(domain string) {
+			if !acmeEnable || !acmePreIssue {
+				return
+			}
+
+			select {
+			case newDomains <- domain:
+			default:
+				log.Error().Str("domain", domain).Msg("too many domains to pre-issue, skipped")
+			}
+		}),
 		baker.WithRules(
 			rule.RegisterAppendPath(),
 			rule.RegisterReplacePath(),
 			rule.RegisterRateLimiter(),
+			rule.RegisterMirror(),
+			rule.RegisterHeaders(),
+			rule.RegisterCORS(),
+			rule.RegisterBasicAuth(),
+			rule.RegisterAPIKey(),
+			rule.RegisterJWT(),
+			rule.RegisterForwardAuth(),
+			rule.RegisterIPFilter(),
+			rule.RegisterCompress(),
+			rule.RegisterCache(),
+			rule.RegisterLimits(),
+			rule.RegisterRedirect(),
+			rule.RegisterRewrite(),
+			rule.RegisterRespond(),
+			rule.RegisterMaintenance(),
+			rule.RegisterErrorPages(),
 		),
 	)
 
+	// HTTP/2 is negotiated using TLS, h2c accepts it without TLS too,
+	// which gRPC clients rely on
+	handler := h2c.NewHandler(baker, &http2.Server{})
+
+	if adminAddr != "" {
+		go func() {
+			err := http.ListenAndServe(adminAddr, baker.Admin())
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to start admin server")
+			}
+		}()
+	}
+
+	for _, port := range strings.Split(tcpPorts, ",") {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+
+		l, err := listenerConfig.Listen(":" + port)
+		if err != nil {
+			log.Fatal().Err(err).Str("port", port).Msg("failed to listen on tcp port")
+		}
+
+		go func() {
+			err := baker.ServeTCP(l)
+			if err != nil {
+				log.Fatal().Err(err).Str("addr", l.Addr().String()).Msg("failed to serve tcp")
+			}
+		}()
+	}
+
+	for _, port := range strings.Split(udpPorts, ",") {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+
+		conn, err := net.ListenPacket("udp", ":"+port)
+		if err != nil {
+			log.Fatal().Err(err).Str("port", port).Msg("failed to listen on udp port")
+		}
+
+		go func() {
+			err := baker.ServeUDP(conn)
+			if err != nil {
+				log.Fatal().Err(err).Str("addr", conn.LocalAddr().String()).Msg("failed to serve udp")
+			}
+		}()
+	}
+
+	if sniAddr != "" {
+		l, err := listenerConfig.Listen(sniAddr)
+		if err != nil {
+			log.Fatal().Err(err).Str("addr", sniAddr).Msg("failed to listen for sni")
+		}
+
+		go func() {
+			err := baker.ServeSNI(l)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to serve sni")
+			}
+		}()
+	}
+
 	if acmeEnable {
-		err := acme.Start(baker, acmePath)
+		// TLS connections to the SNI of an endpoint are passed through
+		acmeOpts := []acme.Option{
+			acme.WithListenerConfig(listenerConfig),
+			acme.WithTLSListener(baker.SNIListener),
+			acme.WithCertStore(certStore),
+			acme.WithPreIssue(newDomains),
+		}
+
+		// certificates are only requested for the domains of the containers
+		// and the ones listed, so unknown names can't exhaust the rate limits
+		allowList := make(map[string]bool)
+		for _, domain := range strings.Split(acmeDomains, ",") {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				allowList[domain] = true
+			}
+		}
+
+		acmeOpts = append(acmeOpts, acme.WithHostPolicy(func(host string) bool {
+			return allowList[host] || baker.HasDomain(host)
+		}))
+
+		serverOpts, err := acmeServerOptions(os.Getenv)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid acme config")
+		}
+		acmeOpts = append(acmeOpts, serverOpts...)
+
+		if http3Enable {
+			acmeOpts = append(acmeOpts, acme.WithHTTP3())
+		}
+
+		switch httpMode {
+		case "", "redirect":
+			if httpRedirectCode != "" {
+				statusCode, err := strconv.Atoi(httpRedirectCode)
+				if err != nil || !isRedirectCode(statusCode) {
+					log.Fatal().Str("code", httpRedirectCode).Msg("invalid BAKER_HTTP_REDIRECT_CODE")
+				}
+				acmeOpts = append(acmeOpts, acme.WithHTTPSRedirect(statusCode))
+			}
+		case "serve":
+			acmeOpts = append(acmeOpts, acme.WithHTTPHandler(handler))
+		default:
+			log.Fatal().Str("mode", httpMode).Msg("invalid BAKER_HTTP_MODE, expected redirect or serve")
+		}
+
+		err = acme.Start(handler, acmePath, acmeOpts...)
 		if err != nil {
 			log.Fatal().Err(err).Msg("failed to start acme")
 		}
 	} else {
-		err := http.ListenAndServe(":80", baker)
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to start server")
+		server := listenerConfig.NewServer(handler)
+		errs := make(chan error, len(listenerConfig.HTTPAddrs)+len(listenerConfig.HTTPSAddrs))
+
+		for _, addr := range listenerConfig.HTTPAddrs {
+			l, err := listenerConfig.Listen(addr)
+			if err != nil {
+				log.Fatal().Err(err).Str("addr", addr).Msg("failed to listen")
+			}
+
+			go func() {
+				errs <- server.Serve(l)
+			}()
+		}
+
+		// without ACME, https is served with the static certificates, those of
+		// BAKER_CERTS_DIR and those the endpoints reference, only if asked for
+		if certsDir != "" || os.Getenv("BAKER_HTTPS_ADDRS") != "" {
+			tlsServer := listenerConfig.NewTLSServer(handler, certStore.GetCertificate)
+
+			for _, addr := range listenerConfig.HTTPSAddrs {
+				l, err := listenerConfig.Listen(addr)
+				if err != nil {
+					log.Fatal().Err(err).Str("addr", addr).Msg("failed to listen")
+				}
+
+				go func() {
+					errs <- tlsServer.ServeTLS(baker.SNIListener(l), "", "")
+				}()
+			}
 		}
+
+		err := <-errs
+		log.Fatal().Err(err).Msg("failed to start server")
 	}
 }
+
+// acmeServerOptions configures the ACME server, its account
+// and the DNS-01 challenges from the BAKER_ACME_* variables
+func acmeServerOptions(getenv func(string) string) ([]acme.Option, error) {
+	var opts []acme.Option
+
+	if directoryURL := getenv("BAKER_ACME_DIRECTORY_URL"); directoryURL != "" {
+		var rootCAs *x509.CertPool
+
+		if caFile := getenv("BAKER_ACME_DIRECTORY_CA"); caFile != "" {
+			data, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+
+			rootCAs = x509.NewCertPool()
+			if !rootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("invalid BAKER_ACME_DIRECTORY_CA %q", caFile)
+			}
+		}
+
+		opts = append(opts, acme.WithDirectoryURL(directoryURL, rootCAs))
+	}
+
+	if keyID := getenv("BAKER_ACME_EAB_KID"); keyID != "" {
+		// CAs hand the key out base64url encoded, with or without padding
+		encoded := strings.TrimRight(getenv("BAKER_ACME_EAB_HMAC_KEY"), "=")
+		hmacKey, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil || len(hmacKey) == 0 {
+			return nil, fmt.Errorf("invalid BAKER_ACME_EAB_HMAC_KEY")
+		}
+
+		opts = append(opts, acme.WithExternalAccountBinding(keyID, hmacKey))
+	}
+
+	switch provider := strings.ToLower(getenv("BAKER_ACME_DNS01")); provider {
+	case "":
+	case "rfc2136":
+		dns01 := acme.DNS01{
+			Provider: &rfc2136.Provider{
+				Nameserver:    getenv("BAKER_RFC2136_NAMESERVER"),
+				Zone:          getenv("BAKER_RFC2136_ZONE"),
+				TSIGKey:       getenv("BAKER_RFC2136_TSIG_KEY"),
+				TSIGSecret:    getenv("BAKER_RFC2136_TSIG_SECRET"),
+				TSIGAlgorithm: getenv("BAKER_RFC2136_TSIG_ALGORITHM"),
+			},
+		}
+
+		if getenv("BAKER_RFC2136_NAMESERVER") == "" {
+			return nil, fmt.Errorf("BAKER_RFC2136_NAMESERVER is required")
+		}
+
+		for _, domain := range strings.Split(getenv("BAKER_ACME_DNS01_DOMAINS"), ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				dns01.Domains = append(dns01.Domains, domain)
+			}
+		}
+
+		if value := getenv("BAKER_ACME_DNS01_PROPAGATION_DELAY"); value != "" {
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay < 0 {
+				return nil, fmt.Errorf("invalid BAKER_ACME_DNS01_PROPAGATION_DELAY %q", value)
+			}
+			dns01.PropagationDelay = delay
+		}
+
+		opts = append(opts, acme.WithDNS01(dns01))
+	default:
+		return nil, fmt.Errorf("unknown BAKER_ACME_DNS01 provider %q, expected rfc2136", provider)
+	}
+
+	return opts, nil
+}
+
+// isRedirectCode reports whether statusCode redirects to the Location header,
+// 300 and 304 don't, and 305 and 306 are deprecated
+func isRedirectCode(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently,
+		http.StatusFound,
+		http.StatusSeeOther,
+		http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+		return true
+	}
+
+	return false
+}
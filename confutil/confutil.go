@@ -5,29 +5,38 @@ import (
 	"net/http"
 )
 
+type endpoint struct {
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	Rule   []struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	} `json:"rules"`
+	Ready             bool   `json:"ready"`
+	ParamHeaderPrefix string `json:"param_header_prefix,omitempty"`
+	Match             any    `json:"match,omitempty"`
+	PathType          string `json:"path_type,omitempty"`
+	Version           string `json:"version,omitempty"`
+	Split             any    `json:"split,omitempty"`
+	Balance           string `json:"balance,omitempty"`
+	Upgrade           any    `json:"upgrade,omitempty"`
+	HTTP2             bool   `json:"http2,omitempty"`
+	HealthCheck       any    `json:"health_check,omitempty"`
+	Port              int    `json:"port,omitempty"`
+	SNI               string `json:"sni,omitempty"`
+	TargetPort        int    `json:"target_port,omitempty"`
+	Protocol          string `json:"protocol,omitempty"`
+	IdleTimeout       string `json:"idle_timeout,omitempty"`
+	Certificate       any    `json:"certificate,omitempty"`
+}
+
 type endpoints struct {
 	cahced     []byte
-	collection []struct {
-		Domain string `json:"domain"`
-		Path   string `json:"path"`
-		Rule   []struct {
-			Type string `json:"type"`
-			Args any    `json:"args"`
-		} `json:"rules"`
-		Ready bool `json:"ready"`
-	}
+	collection []endpoint
 }
 
 func (e *endpoints) New(domain, path string, ready bool) *endpoints {
-	e.collection = append(e.collection, struct {
-		Domain string `json:"domain"`
-		Path   string `json:"path"`
-		Rule   []struct {
-			Type string `json:"type"`
-			Args any    `json:"args"`
-		} `json:"rules"`
-		Ready bool `json:"ready"`
-	}{
+	e.collection = append(e.collection, endpoint{
 		Domain: domain,
 		Path:   path,
 		Ready:  ready,
@@ -35,6 +44,40 @@ func (e *endpoints) New(domain, path string, ready bool) *endpoints {
 	return e
 }
 
+// NewTCP adds an endpoint proxying the connections baker receives on port
+// to targetPort of the container, or its port if targetPort is 0
+func (e *endpoints) NewTCP(port int, targetPort int) *endpoints {
+	e.collection = append(e.collection, endpoint{
+		Port:       port,
+		TargetPort: targetPort,
+		Ready:      true,
+	})
+	return e
+}
+
+// NewUDP adds an endpoint forwarding the datagrams baker receives on port
+// to targetPort of the container, or its port if targetPort is 0
+func (e *endpoints) NewUDP(port int, targetPort int) *endpoints {
+	e.collection = append(e.collection, endpoint{
+		Port:       port,
+		Protocol:   "udp",
+		TargetPort: targetPort,
+		Ready:      true,
+	})
+	return e
+}
+
+// NewSNI adds an endpoint passing the TLS connections for serverName through
+// to targetPort of the container, or its port if targetPort is 0
+func (e *endpoints) NewSNI(serverName string, targetPort int) *endpoints {
+	e.collection = append(e.collection, endpoint{
+		SNI:        serverName,
+		TargetPort: targetPort,
+		Ready:      true,
+	})
+	return e
+}
+
 func (e *endpoints) WithRules(rules ...struct {
 	Type string `json:"type"`
 	Args any    `json:"args"`
@@ -48,6 +91,136 @@ func (e *endpoints) WithRules(rules ...struct {
 	return e
 }
 
+// WithParamHeaderPrefix forwards the named path parameters of the last endpoint
+// to the container as headers starting with prefix
+func (e *endpoints) WithParamHeaderPrefix(prefix string) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].ParamHeaderPrefix = prefix
+
+	return e
+}
+
+// WithRegexPath marks the path of the last endpoint as a regular expression
+func (e *endpoints) WithRegexPath() *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].PathType = "regex"
+
+	return e
+}
+
+// WithVersion labels the last endpoint with version
+func (e *endpoints) WithVersion(version string) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].Version = version
+
+	return e
+}
+
+// WithSplit sets the traffic split of the last endpoint's route, split is encoded
+// as is and should follow the shape of baker.Split
+func (e *endpoints) WithSplit(split any) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].Split = split
+
+	return e
+}
+
+// WithMatch sets the match conditions of the last endpoint, match is encoded as is
+// and should follow the shape of baker.Match
+func (e *endpoints) WithMatch(match any) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].Match = match
+
+	return e
+}
+
+// WithBalance sets how the containers of the last endpoint's route are selected,
+// either random or least_conn
+func (e *endpoints) WithBalance(balance string) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].Balance = balance
+
+	return e
+}
+
+// WithUpgrade configures the upgraded connections of the last endpoint, upgrade is
+// encoded as is and should follow the shape of baker.Upgrade
+func (e *endpoints) WithUpgrade(upgrade any) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].Upgrade = upgrade
+
+	return e
+}
+
+// WithHTTP2 proxies the requests of the last endpoint to the container over h2c
+func (e *endpoints) WithHTTP2() *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].HTTP2 = true
+
+	return e
+}
+
+// WithHealthCheck sets the health check of the last endpoint, healthCheck is
+// encoded as is and should follow the shape of baker.HealthCheck
+func (e *endpoints) WithHealthCheck(healthCheck any) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].HealthCheck = healthCheck
+
+	return e
+}
+
+// WithIdleTimeout sets the idle timeout of the last endpoint, a duration such as 30s
+func (e *endpoints) WithIdleTimeout(timeout string) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].IdleTimeout = timeout
+
+	return e
+}
+
+// WithCertificate sets the certificate of the last endpoint's domain
+func (e *endpoints) WithCertificate(certFile string, keyFile string) *endpoints {
+	if len(e.collection) == 0 {
+		return e
+	}
+
+	e.collection[len(e.collection)-1].Certificate = map[string]string{
+		"cert_file": certFile,
+		"key_file":  keyFile,
+	}
+
+	return e
+}
+
 // CacheResponse caches the response and this can be used to optimize the response
 // If you call this method, the next call should be WriteResponse
 func (e *endpoints) CacheResponse() *endpoints {
@@ -0,0 +1,315 @@
+package baker
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+	"github.com/alinz/baker.go/pkg/sni"
+)
+
+const (
+	layer4DialTimeout = 5 * time.Second
+	sniPeekTimeout    = 5 * time.Second
+)
+
+// isLayer4 reports whether the endpoint routes raw connections, by port or
+// by SNI, instead of http requests by domain and path
+func (e *Endpoint) isLayer4() bool {
+	return e.Port != 0 || e.SNI != ""
+}
+
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// targetAddr returns the address of container the connections are proxied to
+func (e *Endpoint) targetAddr(container *Container) netip.AddrPort {
+	if e.TargetPort == 0 {
+		return container.Addr
+	}
+	return netip.AddrPortFrom(container.Addr.Addr(), uint16(e.TargetPort))
+}
+
+func (e *Endpoint) layer4Key() string {
+	if e.SNI != "" {
+		return sniKey(e.SNI)
+	}
+	if e.Protocol == ProtocolUDP {
+		return udpKey(e.Port)
+	}
+	return tcpKey(e.Port)
+}
+
+func tcpKey(port int) string {
+	return ProtocolTCP + "/" + strconv.Itoa(port)
+}
+
+func udpKey(port int) string {
+	return ProtocolUDP + "/" + strconv.Itoa(port)
+}
+
+func sniKey(serverName string) string {
+	return "sni/" + strings.ToLower(serverName)
+}
+
+func (e *Endpoint) validateLayer4() error {
+	if e.Port < 0 || e.Port > 65535 {
+		return fmt.Errorf("invalid port %d", e.Port)
+	}
+
+	if e.TargetPort < 0 || e.TargetPort > 65535 {
+		return fmt.Errorf("invalid target port %d", e.TargetPort)
+	}
+
+	if e.Port != 0 && e.SNI != "" {
+		return fmt.Errorf("port and sni can't be both set")
+	}
+
+	switch e.Protocol {
+	case "":
+	case ProtocolTCP, ProtocolUDP:
+		if e.Port == 0 {
+			return fmt.Errorf("protocol %s requires a port", e.Protocol)
+		}
+	default:
+		return fmt.Errorf("unknown protocol %q", e.Protocol)
+	}
+
+	if e.IdleTimeout.Duration < 0 {
+		return fmt.Errorf("negative idle timeout")
+	}
+
+	return nil
+}
+
+// service returns the service of endpoint, either routed by domain
+// and path, or for layer 4 endpoints, by port or SNI
+func (s *Server) service(endpoint *Endpoint, insert bool) *Service {
+	if !endpoint.isLayer4() {
+		return s.domains.Endpoint(endpoint, insert)
+	}
+
+	key := endpoint.layer4Key()
+
+	if service, ok := s.layer4.Get(key); ok {
+		return service
+	} else if !insert {
+		return emptyService
+	}
+
+	service := NewService()
+	s.layer4.Put(key, service)
+
+	return service
+}
+
+// sniService returns the service of serverName, an exact
+// match is preferred over a wildcard one, e.g. *.example.com
+func (s *Server) sniService(serverName string) (*Service, bool) {
+	if serverName == "" {
+		return nil, false
+	}
+
+	if service, ok := s.layer4.Get(sniKey(serverName)); ok {
+		return service, true
+	}
+
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		return s.layer4.Get(sniKey("*." + parent))
+	}
+
+	return nil, false
+}
+
+// Pick selects a container regardless of any request, as
+// for the connections of layer 4 endpoints
+func (s *Service) Pick() (*Container, *Endpoint, bool) {
+	var candidates []*value
+
+	s.containers.Iterate(func(_ string, value *value) bool {
+		if !value.container.Draining() {
+			candidates = append(candidates, value)
+		}
+		return true
+	})
+
+	if len(candidates) == 0 {
+		return nil, nil, false
+	}
+
+	value := balance(candidates)
+	return value.container, value.endpoint, true
+}
+
+// proxyConn proxies conn to one of the containers of service
+// until either side closes the connection
+func (s *Server) proxyConn(conn net.Conn, service *Service) {
+	container, endpoint, ok := service.Pick()
+	if !ok {
+		conn.Close()
+		return
+	}
+
+	addr := endpoint.targetAddr(container)
+
+	upstream, err := net.DialTimeout("tcp", addr.String(), layer4DialTimeout)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("container_id", container.ID).
+			Str("addr", addr.String()).
+			Msg("failed to reach the container")
+		conn.Close()
+		return
+	}
+
+	container.active.Add(1)
+	defer container.active.Add(-1)
+
+	pipe(newUpgradedConn(conn, container, &Upgrade{IdleTimeout: endpoint.IdleTimeout}), upstream)
+}
+
+// pipe copies data in both directions, once one side is done
+// sending, the other side is told so it can finish too
+func pipe(client net.Conn, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	copyTo := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+
+		io.Copy(dst, src)
+
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+
+	go copyTo(upstream, client)
+	go copyTo(client, upstream)
+
+	wg.Wait()
+
+	client.Close()
+	upstream.Close()
+}
+
+// ServeTCP accepts the connections of l and proxies them to the containers
+// of the endpoints whose Port is the port l listens on
+func (s *Server) ServeTCP(l net.Listener) error {
+	addr, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("%s is not a tcp address", l.Addr())
+	}
+
+	key := tcpKey(addr.Port)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		service, ok := s.layer4.Get(key)
+		if !ok {
+			conn.Close()
+			continue
+		}
+
+		go s.proxyConn(conn, service)
+	}
+}
+
+// ServeSNI accepts the TLS connections of l and proxies them, without
+// terminating TLS, to the containers of the endpoints whose SNI is the server
+// name sent by the client. Other connections are closed.
+func (s *Server) ServeSNI(l net.Listener) error {
+	sl := s.SNIListener(l)
+
+	for {
+		conn, err := sl.Accept()
+		if err != nil {
+			return err
+		}
+
+		conn.Close()
+	}
+}
+
+// SNIListener proxies the TLS connections of l whose server name is the SNI of
+// an endpoint, as ServeSNI does. Other connections are returned by Accept, so
+// they can be served by a TLS server terminating them.
+func (s *Server) SNIListener(l net.Listener) net.Listener {
+	return &sniListener{
+		Listener: l,
+		server:   s,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+}
+
+type sniListener struct {
+	net.Listener
+	server *Server
+	conns  chan net.Conn
+	once   sync.Once
+	done   chan struct{}
+	err    error
+}
+
+func (l *sniListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		go l.accept()
+	})
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// accept peeks the connections in the background, so slow
+// clients don't hold back the other ones
+func (l *sniListener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.done)
+			return
+		}
+
+		go l.route(conn)
+	}
+}
+
+func (l *sniListener) route(conn net.Conn) {
+	serverName, peeked, err := sni.Peek(conn, sniPeekTimeout)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if service, ok := l.server.sniService(serverName); ok {
+		l.server.proxyConn(peeked, service)
+		return
+	}
+
+	select {
+	case l.conns <- peeked:
+	case <-l.done:
+		peeked.Close()
+	}
+}
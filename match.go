@@ -0,0 +1,143 @@
+package baker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/alinz/baker.go/pkg/regexps"
+)
+
+// compileRegexp compiles expr once and reuses the result, since endpoints
+// are decoded again every time the pinger refreshes a container
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	return regexps.Compile(expr)
+}
+
+// compilePathRegexp compiles a regex path so it has to match the whole path
+func compilePathRegexp(expr string) (*regexp.Regexp, error) {
+	return compileRegexp("^(?:" + expr + ")$")
+}
+
+// Condition matches a single named value of a request, a header, a query
+// parameter or a cookie. If Regex is set, the value must match it, if Value is set,
+// the value must be equal to it, otherwise the value only needs to be present.
+type Condition struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Regex string `json:"regex"`
+	regex *regexp.Regexp
+}
+
+func (c *Condition) compile() (err error) {
+	if c.Name == "" {
+		return fmt.Errorf("condition name is required")
+	}
+
+	if c.Regex != "" {
+		c.regex, err = compileRegexp(c.Regex)
+	}
+
+	return err
+}
+
+func (c *Condition) matches(values []string) bool {
+	for _, value := range values {
+		switch {
+		case c.regex != nil:
+			if c.regex.MatchString(value) {
+				return true
+			}
+		case c.Value != "":
+			if c.Value == value {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match narrows down which requests are routed to an endpoint. When several endpoints
+// share the same domain and path, the matching endpoint with the highest Priority wins,
+// ties are broken by the number of conditions, so the most specific endpoint is selected.
+type Match struct {
+	Methods  []string    `json:"methods"`
+	Headers  []Condition `json:"headers"`
+	Query    []Condition `json:"query"`
+	Cookies  []Condition `json:"cookies"`
+	Priority int         `json:"priority"`
+}
+
+func (m *Match) compile() error {
+	for _, conditions := range [][]Condition{m.Headers, m.Query, m.Cookies} {
+		for i := range conditions {
+			if err := conditions[i].compile(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Match) specificity() int {
+	n := len(m.Headers) + len(m.Query) + len(m.Cookies)
+	if len(m.Methods) > 0 {
+		n++
+	}
+	return n
+}
+
+func (m *Match) key() string {
+	b, _ := json.Marshal(m)
+	return string(b)
+}
+
+func (m *Match) matches(r *http.Request) bool {
+	if len(m.Methods) > 0 {
+		found := false
+		for _, method := range m.Methods {
+			if strings.EqualFold(method, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for i := range m.Headers {
+		if !m.Headers[i].matches(r.Header.Values(m.Headers[i].Name)) {
+			return false
+		}
+	}
+
+	if len(m.Query) > 0 {
+		query := r.URL.Query()
+		for i := range m.Query {
+			if !m.Query[i].matches(query[m.Query[i].Name]) {
+				return false
+			}
+		}
+	}
+
+	for i := range m.Cookies {
+		var values []string
+		for _, cookie := range r.Cookies() {
+			if cookie.Name == m.Cookies[i].Name {
+				values = append(values, cookie.Value)
+			}
+		}
+		if !m.Cookies[i].matches(values) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -2,15 +2,20 @@ package baker_test
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/alinz/baker.go"
 	"github.com/alinz/baker.go/pkg/collection"
 	"github.com/alinz/baker.go/rule"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func MockDriver(t *testing.T, confs ...interface{ WriteResponse(w http.ResponseWriter) }) <-chan *baker.Container {
@@ -20,15 +25,36 @@ func MockDriver(t *testing.T, confs ...interface{ WriteResponse(w http.ResponseW
 
 	for i, conf := range confs {
 		server := func(conf interface{ WriteResponse(w http.ResponseWriter) }) *httptest.Server {
-			return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				if r.URL.Path == "/config" {
 					conf.WriteResponse(w)
 					return
 				}
 
-				w.WriteHeader(http.StatusOK)
+				if strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+					echoGRPC(w, r)
+					return
+				}
+
+				if r.Header.Get("Upgrade") != "" {
+					echoUpgrade(w, r)
+					return
+				}
+
+				if sleep, err := time.ParseDuration(r.URL.Query().Get("sleep")); err == nil {
+					time.Sleep(sleep)
+				}
+				io.Copy(io.Discard, r.Body)
+
+				w.Header().Set("X-Upstream-Uri", r.URL.RequestURI())
+				status := http.StatusOK
+				if code, err := strconv.Atoi(r.URL.Query().Get("status")); err == nil {
+					status = code
+				}
+
+				w.WriteHeader(status)
 				w.Write([]byte(`{}`))
-			}))
+			}), &http2.Server{}))
 		}(conf)
 
 		addr, err := netip.ParseAddrPort(server.Listener.Addr().String())
@@ -54,7 +80,48 @@ func MockDriver(t *testing.T, confs ...interface{ WriteResponse(w http.ResponseW
 	return containers
 }
 
+// echoUpgrade switches to the requested protocol and echoes whatever is received
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", r.Header.Get("Upgrade"))
+	brw.Flush()
+
+	io.Copy(conn, brw)
+}
+
+// echoGRPC echoes the request, and reports the services whose
+// name starts with down as not serving to the health checks
+func echoGRPC(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, X-Upstream-Proto")
+
+	if r.URL.Path == "/grpc.health.v1.Health/Check" {
+		status := byte(1)
+		if strings.HasPrefix(string(body[5:]), "\x0a\x04down") {
+			status = 2
+		}
+		body = []byte{0, 0, 0, 0, 2, 0x08, status}
+	}
+
+	w.Write(body)
+
+	w.Header().Set("Grpc-Status", "0")
+	w.Header().Set("X-Upstream-Proto", r.Proto)
+}
+
 func StartBakerServer(t *testing.T, containers <-chan *baker.Container, size int) (url string) {
+	_, url = StartBaker(t, containers, size)
+	return url
+}
+
+func StartBaker(t *testing.T, containers <-chan *baker.Container, size int) (*baker.Server, string) {
 	done := make(chan struct{}, 1)
 
 	baker := baker.New(
@@ -64,6 +131,22 @@ func StartBakerServer(t *testing.T, containers <-chan *baker.Container, size int
 			rule.RegisterAppendPath(),
 			rule.RegisterReplacePath(),
 			rule.RegisterRateLimiter(),
+			rule.RegisterMirror(),
+			rule.RegisterHeaders(),
+			rule.RegisterCORS(),
+			rule.RegisterBasicAuth(),
+			rule.RegisterAPIKey(),
+			rule.RegisterJWT(),
+			rule.RegisterForwardAuth(),
+			rule.RegisterIPFilter(),
+			rule.RegisterCompress(),
+			rule.RegisterCache(),
+			rule.RegisterLimits(),
+			rule.RegisterRedirect(),
+			rule.RegisterRewrite(),
+			rule.RegisterRespond(),
+			rule.RegisterMaintenance(),
+			rule.RegisterErrorPages(),
 		),
 		baker.WithOnAfterPinger(func(containerSet *collection.Set[string, *baker.Container]) {
 			if containerSet.Len() == size && done != nil {
@@ -73,10 +156,10 @@ func StartBakerServer(t *testing.T, containers <-chan *baker.Container, size int
 		}),
 	)
 
-	s := httptest.NewServer(baker)
+	s := httptest.NewServer(h2c.NewHandler(baker, &http2.Server{}))
 	t.Cleanup(s.Close)
 
 	<-done
 
-	return s.URL
+	return baker, s.URL
 }
@@ -3,64 +3,319 @@ package acme
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
-	"time"
 
+	"github.com/alinz/baker.go/pkg/certstore"
+	"github.com/alinz/baker.go/pkg/listener"
+	"github.com/alinz/baker.go/pkg/log"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
-func Start(handler http.Handler, cachePath string) error {
+type config struct {
+	httpHandler http.Handler
+	tlsListener func(net.Listener) net.Listener
+	http3       bool
+	listener    listener.Config
+	certStore   *certstore.Store
+	allowed     func(host string) bool
+	preIssue    <-chan string
+
+	directoryURL string
+	rootCAs      *x509.CertPool
+	eab          *acme.ExternalAccountBinding
+	dns01        *DNS01
+}
+
+type Option func(*config)
+
+// WithHTTPHandler serves the requests received over http, other than the ACME
+// challenges, using handler. Use it with the baker handler to serve http and https.
+func WithHTTPHandler(handler http.Handler) Option {
+	return func(c *config) {
+		c.httpHandler = handler
+	}
+}
+
+// WithHTTPSRedirect redirects the requests received over http to https
+// using statusCode, which is 308 by default, so the method and body are kept
+func WithHTTPSRedirect(statusCode int) Option {
+	return WithHTTPHandler(RedirectHTTPS(statusCode))
+}
+
+// WithTLSListener wraps the https listeners, e.g. with
+// baker.Server.SNIListener to pass some TLS connections through
+func WithTLSListener(wrap func(net.Listener) net.Listener) Option {
+	return func(c *config) {
+		c.tlsListener = wrap
+	}
+}
+
+// WithListenerConfig sets the addresses, timeouts and TLS settings of the
+// servers, listener.Default is used otherwise
+func WithListenerConfig(listenerConfig listener.Config) Option {
+	return func(c *config) {
+		c.listener = listenerConfig
+	}
+}
+
+// WithCertStore serves the static certificates of store, Let's Encrypt
+// only issues the certificates of the domains none of them covers
+func WithCertStore(store *certstore.Store) Option {
+	return func(c *config) {
+		c.certStore = store
+	}
+}
+
+// WithHostPolicy only issues the certificates of the hosts allowed, e.g.
+// the domains of baker.Server.HasDomain. Without it, a certificate is
+// requested for any server name sent by clients.
+func WithHostPolicy(allowed func(host string) bool) Option {
+	return func(c *config) {
+		c.allowed = allowed
+	}
+}
+
+// WithPreIssue issues the certificate of each domain received from domains,
+// unless one is cached or static, so the first request isn't held back
+func WithPreIssue(domains <-chan string) Option {
+	return func(c *config) {
+		c.preIssue = domains
+	}
+}
+
+// WithDirectoryURL uses the ACME server of url instead of Let's Encrypt, e.g.
+// its staging, ZeroSSL, or a local Pebble. rootCAs, if not nil, are the
+// authorities trusted to connect to the server, as Pebble has its own.
+func WithDirectoryURL(url string, rootCAs *x509.CertPool) Option {
+	return func(c *config) {
+		c.directoryURL = url
+		c.rootCAs = rootCAs
+	}
+}
+
+// WithExternalAccountBinding binds the ACME account to the account keyID
+// of the CA, as required by ZeroSSL for example. hmacKey is decoded.
+func WithExternalAccountBinding(keyID string, hmacKey []byte) Option {
+	return func(c *config) {
+		c.eab = &acme.ExternalAccountBinding{KID: keyID, Key: hmacKey}
+	}
+}
+
+// WithDNS01 issues the certificates of dns01.Domains using DNS-01
+// challenges, or every certificate if it lists no domain, which
+// requires WithHostPolicy
+func WithDNS01(dns01 DNS01) Option {
+	return func(c *config) {
+		c.dns01 = &dns01
+	}
+}
+
+// newClient returns an ACME client of the configured server,
+// each client registers the account the first time it is used
+func (c *config) newClient() *acme.Client {
+	client := &acme.Client{
+		DirectoryURL: c.directoryURL,
+		UserAgent:    "baker",
+	}
+
+	if c.rootCAs != nil {
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: c.rootCAs},
+			},
+		}
+	}
+
+	return client
+}
+
+// hostPolicy rejects the hosts which are not allowed, before any
+// request is sent to the ACME server
+func hostPolicy(allowed func(host string) bool) autocert.HostPolicy {
+	return func(_ context.Context, host string) error {
+		if !allowed(host) {
+			return fmt.Errorf("acme: host %q is not allowed", host)
+		}
+		return nil
+	}
+}
+
+// preIssue requests the certificate of every domain received, as an ECDSA
+// capable client would, which is what autocert issues for most clients
+func preIssue(domains <-chan string, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	for domain := range domains {
+		hello := &tls.ClientHelloInfo{
+			ServerName:       domain,
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+
+		if _, err := getCertificate(hello); err != nil {
+			log.Error().Err(err).Str("domain", domain).Msg("failed to pre-issue certificate")
+			continue
+		}
+
+		log.Info().Str("domain", domain).Msg("certificate pre-issued")
+	}
+}
+
+// Start serves handler over TLS, with certificates issued by Let's Encrypt, on
+// the https addresses, and the ACME challenges on the http ones. It returns once
+// one of the listeners fails, after shutting down the other ones.
+func Start(handler http.Handler, cachePath string, opts ...Option) error {
 	if cachePath == "" {
 		cachePath = "."
 	}
 
+	conf := &config{
+		httpHandler: RedirectHTTPS(http.StatusPermanentRedirect),
+		listener:    listener.Default(),
+	}
+
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	// any name a client sends would be issued otherwise
+	if conf.dns01 != nil && len(conf.dns01.Domains) == 0 && conf.allowed == nil {
+		return errors.New("acme: dns-01 without domains requires a host policy")
+	}
+
+	cache := autocert.DirCache(cachePath)
+
 	certManager := autocert.Manager{
-		Prompt: autocert.AcceptTOS,
-		Cache:  autocert.DirCache(cachePath),
+		Prompt:                 autocert.AcceptTOS,
+		Cache:                  cache,
+		Client:                 conf.newClient(),
+		ExternalAccountBinding: conf.eab,
+	}
+
+	if conf.allowed != nil {
+		certManager.HostPolicy = hostPolicy(conf.allowed)
+	}
+
+	// static certificates come first, then the DNS-01 ones, then autocert
+	getCertificate := certManager.GetCertificate
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if conf.dns01 != nil {
+		issuer := newDNS01Issuer(*conf.dns01, conf.newClient(), conf.eab, cache, conf.allowed)
+		getCertificate = issuer.getCertificate(getCertificate)
+		go issuer.run(done)
+	}
+
+	if conf.certStore != nil {
+		conf.certStore.SetFallback(getCertificate)
+		getCertificate = conf.certStore.GetCertificate
 	}
 
-	httpsServer := &http.Server{
-		Addr:         ":443",
-		Handler:      handler,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 5 * time.Second,
-		TLSConfig: &tls.Config{
-			GetCertificate: certManager.GetCertificate,
-		},
+	httpsServer := conf.listener.NewTLSServer(handler, getCertificate)
+	httpServer := conf.listener.NewServer(certManager.HTTPHandler(conf.httpHandler))
+
+	var http3Server *http3.Server
+	if conf.http3 {
+		http3Server = &http3.Server{
+			Handler:   handler,
+			TLSConfig: http3.ConfigureTLSConfig(conf.listener.TLSConfig(getCertificate)),
+		}
+		httpsServer.Handler = AltSvc(http3Server, handler)
 	}
 
-	httpServer := &http.Server{
-		Addr:         ":80",
-		Handler:      certManager.HTTPHandler(nil),
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+	var listeners []net.Listener
+	var packetConns []net.PacketConn
+
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, conn := range packetConns {
+			conn.Close()
+		}
 	}
 
-	httpClose := make(chan struct{}, 1)
-	httpsClose := make(chan struct{}, 1)
-	errs := make(chan error, 2)
+	for _, addr := range conf.listener.HTTPAddrs {
+		l, err := conf.listener.Listen(addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, l)
+	}
 
-	go func() {
-		defer close(httpClose)
-		errs <- httpServer.ListenAndServe()
-	}()
+	httpListeners := len(listeners)
 
-	go func() {
-		defer close(httpsClose)
-		errs <- httpsServer.ListenAndServeTLS("", "")
-	}()
+	for _, addr := range conf.listener.HTTPSAddrs {
+		l, err := conf.listener.Listen(addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
 
-	select {
-	case <-httpClose:
-		httpsServer.Shutdown(context.Background())
-	case <-httpsClose:
-		httpServer.Shutdown(context.Background())
+		if conf.tlsListener != nil {
+			l = conf.tlsListener(l)
+		}
+		listeners = append(listeners, l)
+
+		if http3Server != nil {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				closeAll()
+				return err
+			}
+			packetConns = append(packetConns, conn)
+		}
 	}
 
-	select {
-	case err := <-errs:
-		return err
-	default:
-		return nil
+	errs := make(chan error, len(listeners))
+
+	for i, l := range listeners {
+		if i < httpListeners {
+			go func(l net.Listener) {
+				errs <- httpServer.Serve(l)
+			}(l)
+		} else {
+			go func(l net.Listener) {
+				errs <- httpsServer.ServeTLS(l, "", "")
+			}(l)
+		}
+	}
+
+	// HTTP/1.1 and HTTP/2 keep being served if HTTP/3 fails, and it is not
+	// advertised anymore, see AltSvc
+	for _, conn := range packetConns {
+		go func(conn net.PacketConn) {
+			err := http3Server.Serve(conn)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Error().
+					Err(err).
+					Str("addr", conn.LocalAddr().String()).
+					Msg("failed to serve http3")
+			}
+		}(conn)
+	}
+
+	// the challenges are answered by the servers, so they must be started first
+	if conf.preIssue != nil {
+		go preIssue(conf.preIssue, getCertificate)
 	}
+
+	err := <-errs
+
+	httpServer.Shutdown(context.Background())
+	httpsServer.Shutdown(context.Background())
+	if http3Server != nil {
+		http3Server.Close()
+	}
+
+	return err
 }
@@ -0,0 +1,46 @@
+package acme
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostPolicy(t *testing.T) {
+	policy := hostPolicy(func(host string) bool {
+		return host == "example.com"
+	})
+
+	assert.NoError(t, policy(context.Background(), "example.com"))
+	assert.EqualError(t, policy(context.Background(), "attacker.com"), `acme: host "attacker.com" is not allowed`)
+}
+
+func TestStartDNS01WithoutDomains(t *testing.T) {
+	// every name would be issued
+	err := Start(nil, t.TempDir(), WithDNS01(DNS01{}))
+	assert.EqualError(t, err, "acme: dns-01 without domains requires a host policy")
+}
+
+func TestPreIssue(t *testing.T) {
+	domains := make(chan string, 2)
+	domains <- "example.com"
+	domains <- "broken.com"
+	close(domains)
+
+	var issued []string
+	preIssue(domains, func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// an ECDSA certificate is requested, as for most clients
+		assert.Equal(t, []tls.CurveID{tls.CurveP256}, hello.SupportedCurves)
+
+		issued = append(issued, hello.ServerName)
+		if hello.ServerName == "broken.com" {
+			return nil, errors.New("rate limited")
+		}
+		return &tls.Certificate{}, nil
+	})
+
+	assert.Equal(t, []string{"example.com", "broken.com"}, issued)
+}
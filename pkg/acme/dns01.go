@@ -0,0 +1,515 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/singleflight"
+)
+
+// DNSProvider publishes the TXT records of DNS-01 challenges, e.g. rfc2136.Provider
+type DNSProvider interface {
+	// Present adds the TXT record fqdn, e.g. _acme-challenge.example.com.
+	Present(ctx context.Context, fqdn string, value string) error
+	// CleanUp removes the record added by Present
+	CleanUp(ctx context.Context, fqdn string, value string) error
+}
+
+// DNS01 issues certificates using DNS-01 challenges, which is the only way
+// to get wildcard certificates, or certificates of hosts not reachable on port 80
+type DNS01 struct {
+	Provider DNSProvider
+	// Domains are issued using DNS-01 when Start is called, and renewed. A
+	// wildcard, e.g. *.example.com, covers the names of one more label. If
+	// empty, every certificate allowed by the host policy is issued using
+	// DNS-01, when first requested.
+	Domains []string
+	// PropagationDelay is waited for after publishing the records, so the
+	// secondary nameservers of the zone have them
+	PropagationDelay time.Duration
+}
+
+const (
+	dns01RenewBefore   = 30 * 24 * time.Hour
+	dns01RenewInterval = 12 * time.Hour
+	dns01IssueTimeout  = 5 * time.Minute
+	// a name which failed to be issued is retried after a delay,
+	// doubled after each failure
+	dns01RetryMin = time.Minute
+	dns01RetryMax = 6 * time.Hour
+)
+
+// accountKeyName is where autocert caches its account key,
+// so both use the same account
+const accountKeyName = "acme_account+key"
+
+type dns01Issuer struct {
+	DNS01
+	client  *acme.Client
+	eab     *acme.ExternalAccountBinding
+	cache   autocert.Cache
+	allowed func(host string) bool
+
+	registerMu sync.Mutex
+	registered bool
+
+	mu     sync.RWMutex
+	certs  map[string]*tls.Certificate
+	failed map[string]failure
+
+	// a certificate is only issued once at a time, the
+	// other names are not blocked meanwhile
+	issues singleflight.Group
+}
+
+// failure is the last error issuing a name, which is returned until retryAt
+type failure struct {
+	err     error
+	delay   time.Duration
+	retryAt time.Time
+}
+
+func newDNS01Issuer(conf DNS01, client *acme.Client, eab *acme.ExternalAccountBinding, cache autocert.Cache, allowed func(host string) bool) *dns01Issuer {
+	domains := make([]string, 0, len(conf.Domains))
+	for _, domain := range conf.Domains {
+		domains = append(domains, strings.ToLower(domain))
+	}
+	conf.Domains = domains
+
+	return &dns01Issuer{
+		DNS01:   conf,
+		client:  client,
+		eab:     eab,
+		cache:   cache,
+		allowed: allowed,
+		certs:   make(map[string]*tls.Certificate),
+		failed:  make(map[string]failure),
+	}
+}
+
+// certName returns the name of the certificate covering serverName, either one
+// of the domains, the wildcard of serverName, or serverName if domains is empty
+func (d *dns01Issuer) certName(serverName string) (string, bool) {
+	if len(d.Domains) == 0 {
+		return serverName, true
+	}
+
+	wildcard := ""
+	if _, parent, ok := strings.Cut(serverName, "."); ok {
+		wildcard = "*." + parent
+	}
+
+	for _, domain := range d.Domains {
+		if domain == serverName {
+			return domain, true
+		}
+	}
+
+	for _, domain := range d.Domains {
+		if domain == wildcard {
+			return domain, true
+		}
+	}
+
+	return "", false
+}
+
+// getCertificate returns the DNS-01 certificates of the names it covers,
+// the other ones come from fallback
+func (d *dns01Issuer) getCertificate(fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		serverName := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+		name, ok := d.certName(serverName)
+		if !ok || name == "" {
+			return fallback(hello)
+		}
+
+		if !d.isAllowed(name) {
+			return nil, fmt.Errorf("acme: host %q is not allowed", name)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), dns01IssueTimeout)
+		defer cancel()
+
+		return d.certificate(ctx, name)
+	}
+}
+
+// isAllowed reports whether name can be issued, the names
+// the domains don't list explicitly follow the host policy
+func (d *dns01Issuer) isAllowed(name string) bool {
+	return len(d.Domains) > 0 || d.allowed == nil || d.allowed(name)
+}
+
+// certificate returns the certificate of name, from memory, the
+// cache, or by issuing it
+func (d *dns01Issuer) certificate(ctx context.Context, name string) (*tls.Certificate, error) {
+	d.mu.RLock()
+	cert, ok := d.certs[name]
+	failed, hasFailed := d.failed[name]
+	d.mu.RUnlock()
+
+	if ok {
+		return cert, nil
+	}
+
+	// the ACME server is not asked again for a while
+	if hasFailed && time.Now().Before(failed.retryAt) {
+		return nil, failed.err
+	}
+
+	result := d.issues.DoChan(name, func() (any, error) {
+		// it might have been issued while waiting
+		d.mu.RLock()
+		cert, ok := d.certs[name]
+		d.mu.RUnlock()
+
+		if ok {
+			return cert, nil
+		}
+
+		// the order is shared by every caller, so it
+		// doesn't depend on the context of any of them
+		ctx, cancel := context.WithTimeout(context.Background(), dns01IssueTimeout)
+		defer cancel()
+
+		cert, err := d.load(ctx, name)
+		if err != nil || time.Until(cert.Leaf.NotAfter) < dns01RenewBefore {
+			cert, err = d.issue(ctx, name)
+			if err != nil {
+				d.fail(name, err)
+				return nil, err
+			}
+		}
+
+		d.store(name, cert)
+
+		return cert, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-result:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*tls.Certificate), nil
+	}
+}
+
+func (d *dns01Issuer) store(name string, cert *tls.Certificate) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.certs[name] = cert
+	delete(d.failed, name)
+}
+
+// fail remembers the error issuing name, the delay before
+// the next attempt is doubled after each failure
+func (d *dns01Issuer) fail(name string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delay := dns01RetryMin
+	if previous, ok := d.failed[name]; ok {
+		delay = min(previous.delay*2, dns01RetryMax)
+	}
+
+	d.failed[name] = failure{
+		err:     fmt.Errorf("acme: issuing %s failed, retrying in %s: %w", name, delay, err),
+		delay:   delay,
+		retryAt: time.Now().Add(delay),
+	}
+}
+
+// run issues the certificates of the domains, then renews the
+// certificates which expire soon until done is closed
+func (d *dns01Issuer) run(done <-chan struct{}) {
+	for {
+		for _, name := range d.Domains {
+			d.ensure(name)
+		}
+
+		d.mu.RLock()
+		var expiring []string
+		for name, cert := range d.certs {
+			if time.Until(cert.Leaf.NotAfter) < dns01RenewBefore {
+				expiring = append(expiring, name)
+			}
+		}
+		d.mu.RUnlock()
+
+		for _, name := range expiring {
+			// the host policy might not allow it anymore
+			if !d.isAllowed(name) {
+				d.mu.Lock()
+				delete(d.certs, name)
+				d.mu.Unlock()
+				continue
+			}
+
+			d.renew(name)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(dns01RenewInterval):
+		}
+	}
+}
+
+func (d *dns01Issuer) ensure(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dns01IssueTimeout)
+	defer cancel()
+
+	if _, err := d.certificate(ctx, name); err != nil {
+		log.Error().Err(err).Str("domain", name).Msg("failed to issue certificate using dns-01")
+	}
+}
+
+// renew replaces the certificate of name, the current one is
+// served until the new one is issued
+func (d *dns01Issuer) renew(name string) {
+	d.issues.Do(name, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dns01IssueTimeout)
+		defer cancel()
+
+		cert, err := d.issue(ctx, name)
+		if err != nil {
+			log.Error().Err(err).Str("domain", name).Msg("failed to renew certificate using dns-01")
+			return nil, err
+		}
+
+		d.store(name, cert)
+
+		return cert, nil
+	})
+}
+
+// cacheKey doesn't clash with the keys of autocert, which
+// are the names of the certificates
+func cacheKey(name string) string {
+	return "dns01+" + strings.ReplaceAll(name, "*", "_")
+}
+
+func (d *dns01Issuer) load(ctx context.Context, name string) (*tls.Certificate, error) {
+	data, err := d.cache.Get(ctx, cacheKey(name))
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(data, data)
+	if err != nil {
+		return nil, err
+	}
+
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+// register loads the account key cached by autocert, or creates it, and
+// registers the account, which might already exist
+func (d *dns01Issuer) register(ctx context.Context) error {
+	d.registerMu.Lock()
+	defer d.registerMu.Unlock()
+
+	if d.registered {
+		return nil
+	}
+
+	if d.client.Key == nil {
+		key, err := d.accountKey(ctx)
+		if err != nil {
+			return err
+		}
+		d.client.Key = key
+	}
+
+	account := &acme.Account{ExternalAccountBinding: d.eab}
+	_, err := d.client.Register(ctx, account, autocert.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+
+	d.registered = true
+
+	return nil
+}
+
+func (d *dns01Issuer) accountKey(ctx context.Context) (crypto.Signer, error) {
+	data, err := d.cache.Get(ctx, accountKeyName)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("acme: invalid account key")
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := d.cache.Put(ctx, accountKeyName, data); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// issue orders the certificate of name, publishing the
+// records of its challenges using the DNS provider
+func (d *dns01Issuer) issue(ctx context.Context, name string) (*tls.Certificate, error) {
+	if err := d.register(ctx); err != nil {
+		return nil, err
+	}
+
+	order, err := d.client.AuthorizeOrder(ctx, acme.DomainIDs(name))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, url := range order.AuthzURLs {
+		if err := d.authorize(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err = d.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name}}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	der, _, err := d.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var data bytes.Buffer
+	pem.Encode(&data, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	for _, b := range der {
+		pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+
+	// the certificate is still served if it can't be cached
+	if err := d.cache.Put(ctx, cacheKey(name), data.Bytes()); err != nil {
+		log.Error().Err(err).Str("domain", name).Msg("failed to cache certificate")
+	}
+
+	log.Info().Str("domain", name).Time("not_after", leaf.NotAfter).Msg("certificate issued using dns-01")
+
+	return &tls.Certificate{
+		Certificate: der,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// authorize solves the DNS-01 challenge of the authorization url
+func (d *dns01Issuer) authorize(ctx context.Context, url string) error {
+	authz, err := d.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "dns-01" {
+			challenge = c
+			break
+		}
+	}
+
+	if challenge == nil {
+		return fmt.Errorf("acme: no dns-01 challenge for %s", authz.Identifier.Value)
+	}
+
+	value, err := d.client.DNS01ChallengeRecord(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	// wildcard authorizations are for the name without *.
+	fqdn := "_acme-challenge." + authz.Identifier.Value + "."
+
+	if err := d.Provider.Present(ctx, fqdn, value); err != nil {
+		return err
+	}
+	defer func() {
+		if err := d.Provider.CleanUp(context.Background(), fqdn, value); err != nil {
+			log.Error().Err(err).Str("record", fqdn).Msg("failed to clean up dns-01 record")
+		}
+	}()
+
+	if d.PropagationDelay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d.PropagationDelay):
+		}
+	}
+
+	if _, err := d.client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+
+	_, err = d.client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
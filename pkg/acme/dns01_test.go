@@ -0,0 +1,140 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestDNS01CertName(t *testing.T) {
+	d := newDNS01Issuer(DNS01{Domains: []string{"*.Example.com", "www.example.com"}}, nil, nil, nil, nil)
+
+	for serverName, expected := range map[string]string{
+		"www.example.com": "www.example.com",
+		"api.example.com": "*.example.com",
+		"a.b.example.com": "",
+		"example.com":     "",
+	} {
+		name, ok := d.certName(serverName)
+		assert.Equal(t, expected != "", ok, serverName)
+		assert.Equal(t, expected, name, serverName)
+	}
+
+	// without domains, every name is issued using DNS-01
+	d = newDNS01Issuer(DNS01{}, nil, nil, nil, nil)
+	name, ok := d.certName("app.example.org")
+	assert.True(t, ok)
+	assert.Equal(t, "app.example.org", name)
+}
+
+func TestDNS01GetCertificate(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+
+	// a certificate issued earlier is loaded from the cache
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"*.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	var data bytes.Buffer
+	pem.Encode(&data, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pem.Encode(&data, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(t, cache.Put(context.Background(), "dns01+_.example.com", data.Bytes()))
+
+	d := newDNS01Issuer(DNS01{Domains: []string{"*.example.com"}}, &acme.Client{}, nil, cache, nil)
+
+	fallback := &tls.Certificate{}
+	getCertificate := d.getCertificate(func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return fallback, nil
+	})
+
+	cert, err := getCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"*.example.com"}, cert.Leaf.DNSNames)
+
+	cert, err = getCertificate(&tls.ClientHelloInfo{ServerName: "example.org"})
+	assert.NoError(t, err)
+	assert.Same(t, fallback, cert)
+
+	// names which are not listed follow the host policy
+	d = newDNS01Issuer(DNS01{}, &acme.Client{}, nil, cache, func(host string) bool { return false })
+	_, err = d.getCertificate(nil)(&tls.ClientHelloInfo{ServerName: "attacker.com"})
+	assert.EqualError(t, err, `acme: host "attacker.com" is not allowed`)
+}
+
+func TestDNS01Backoff(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	client := &acme.Client{DirectoryURL: server.URL, RetryBackoff: func(int, *http.Request, *http.Response) time.Duration { return -1 }}
+	d := newDNS01Issuer(DNS01{Domains: []string{"example.com"}}, client, nil, autocert.DirCache(t.TempDir()), nil)
+
+	_, err := d.certificate(context.Background(), "example.com")
+	assert.Error(t, err)
+
+	sent := requests.Load()
+	assert.NotZero(t, sent)
+
+	// the ACME server is not asked again until the delay is over
+	_, err = d.certificate(context.Background(), "example.com")
+	assert.Contains(t, err.Error(), "retrying in 1m0s")
+	assert.Equal(t, sent, requests.Load())
+}
+
+func TestDNS01RenewAllowed(t *testing.T) {
+	allowed := true
+	d := newDNS01Issuer(DNS01{}, &acme.Client{}, nil, autocert.DirCache(t.TempDir()), func(host string) bool {
+		return allowed
+	})
+
+	d.certs["old.example.com"] = &tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}}
+
+	// the names the host policy doesn't allow anymore are not renewed
+	allowed = false
+
+	done := make(chan struct{})
+	close(done)
+	d.run(done)
+
+	assert.Empty(t, d.certs)
+}
+
+func TestDNS01AccountKey(t *testing.T) {
+	cache := autocert.DirCache(t.TempDir())
+	d := newDNS01Issuer(DNS01{}, &acme.Client{}, nil, cache, nil)
+
+	key, err := d.accountKey(context.Background())
+	assert.NoError(t, err)
+
+	// the key is kept, where autocert expects it
+	again, err := d.accountKey(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, key.(*ecdsa.PrivateKey).Equal(again))
+
+	_, err = cache.Get(context.Background(), "acme_account+key")
+	assert.NoError(t, err)
+}
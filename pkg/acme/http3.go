@@ -0,0 +1,26 @@
+package acme
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// WithHTTP3 serves HTTP/3 on the https addresses, over UDP, using the same certificates,
+// and advertises it to the HTTP/1.1 and HTTP/2 clients using Alt-Svc
+func WithHTTP3() Option {
+	return func(c *config) {
+		c.http3 = true
+	}
+}
+
+// AltSvc advertises the HTTP/3 server in the responses of next, so clients
+// switch to it for the next requests. Only the addresses the HTTP/3 server
+// is serving are advertised, so nothing is advertised until it listens, nor
+// once Serve returns, as long as server.Addr is not set.
+func AltSvc(server *http3.Server, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.SetQuicHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,69 @@
+package acme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTP3(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+
+	// only used for its certificate
+	tlsServer := httptest.NewTLSServer(handler)
+	t.Cleanup(tlsServer.Close)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: tlsServer.TLS.Certificates}),
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Close() })
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		AltSvc(server, handler).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Header().Get("Alt-Svc") == fmt.Sprintf(`h3=":%d"; ma=2592000`, port)
+	}, time.Second, 10*time.Millisecond)
+
+	client := &http.Client{
+		Transport: &http3.RoundTripper{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	resp, err := client.Get(fmt.Sprintf("https://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "HTTP/3.0", string(body))
+
+	// nothing is advertised once the server stops serving conn
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		AltSvc(server, handler).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Header().Get("Alt-Svc") == ""
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,33 @@
+package acme
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// RedirectHTTPS redirects every request to the same URL using https. The
+// port of the host is dropped, as it belongs to the http server.
+func RedirectHTTPS(statusCode int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+
+		if host == "" {
+			http.Error(w, "missing host", http.StatusBadRequest)
+			return
+		}
+
+		target := &url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     r.URL.Path,
+			RawPath:  r.URL.RawPath,
+			RawQuery: r.URL.RawQuery,
+		}
+
+		http.Redirect(w, r, target.String(), statusCode)
+	})
+}
@@ -0,0 +1,20 @@
+package acme
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectHTTPS(t *testing.T) {
+	handler := RedirectHTTPS(http.StatusPermanentRedirect)
+
+	r := httptest.NewRequest("POST", "http://example.com:80/a/b?c=d", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+	assert.Equal(t, "https://example.com/a/b?c=d", w.Header().Get("Location"))
+}
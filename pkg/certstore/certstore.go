@@ -0,0 +1,372 @@
+// Package certstore selects the certificate of TLS connections by server name
+// among static certificates loaded from disk, and falls back to another source,
+// e.g. ACME, for the names none of them covers.
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNoCertificate = errors.New("no certificate")
+
+// GetCertificateFunc has the signature of tls.Config.GetCertificate
+type GetCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// pair is a certificate and its key, loaded from disk
+type pair struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+	names    []string
+	// added is set once the pair is added by Add or LoadDir, the
+	// pairs only loaded by Assign are removed once unassigned
+	added bool
+}
+
+func loadPair(certFile string, keyFile string) (*pair, error) {
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf = leaf
+
+	names := make([]string, 0, len(leaf.DNSNames)+1)
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+
+	return &pair{
+		certFile: certFile,
+		keyFile:  keyFile,
+		modTime:  modTime,
+		cert:     &cert,
+		names:    names,
+	}, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// Store keeps the static certificates, either found in a directory, or
+// assigned to a domain. Certificates are reloaded once their files change.
+type Store struct {
+	dir string
+
+	mu       sync.RWMutex
+	pairs    map[string]*pair
+	assigned map[string]string
+	fallback GetCertificateFunc
+}
+
+// New creates a store whose relative paths are relative to dir
+func New(dir string) *Store {
+	return &Store{
+		dir:      dir,
+		pairs:    make(map[string]*pair),
+		assigned: make(map[string]string),
+	}
+}
+
+func pairKey(certFile string, keyFile string) string {
+	return certFile + "|" + keyFile
+}
+
+func (s *Store) path(file string) string {
+	if filepath.IsAbs(file) || s.dir == "" {
+		return file
+	}
+	return filepath.Join(s.dir, file)
+}
+
+// SetFallback sets where the certificates of the names which
+// are not covered by any static certificate come from
+func (s *Store) SetFallback(fallback GetCertificateFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fallback = fallback
+}
+
+// Add loads a certificate, which is used for the names it is issued for
+func (s *Store) Add(certFile string, keyFile string) error {
+	return s.add(certFile, keyFile, true)
+}
+
+func (s *Store) add(certFile string, keyFile string, added bool) error {
+	certFile, keyFile = s.path(certFile), s.path(keyFile)
+	key := pairKey(certFile, keyFile)
+
+	s.mu.Lock()
+	p, ok := s.pairs[key]
+	if ok && added {
+		p.added = true
+	}
+	s.mu.Unlock()
+
+	if ok {
+		return nil
+	}
+
+	p, err := loadPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	p.added = added
+
+	s.mu.Lock()
+	s.pairs[key] = p
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Assign loads a certificate and uses it for domain, whichever names it
+// is issued for, as long as it covers domain
+func (s *Store) Assign(domain string, certFile string, keyFile string) error {
+	if err := s.add(certFile, keyFile, false); err != nil {
+		return err
+	}
+
+	key := pairKey(s.path(certFile), s.path(keyFile))
+	domain = strings.ToLower(domain)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.pairs[key]
+	if !ok {
+		return fmt.Errorf("%w for %q", ErrNoCertificate, domain)
+	}
+
+	if err := p.cert.Leaf.VerifyHostname(domain); err != nil {
+		return err
+	}
+
+	s.assigned[domain] = key
+
+	return nil
+}
+
+// Unassign stops using the certificate assigned to domain for it, the
+// certificate is removed unless it was added, or is assigned to another domain
+func (s *Store) Unassign(domain string) {
+	domain = strings.ToLower(domain)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.assigned[domain]
+	if !ok {
+		return
+	}
+	delete(s.assigned, domain)
+
+	if p, ok := s.pairs[key]; ok && !p.added && !s.isAssigned(key) {
+		delete(s.pairs, key)
+	}
+}
+
+func (s *Store) isAssigned(key string) bool {
+	for _, assigned := range s.assigned {
+		if assigned == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes a certificate, and unassigns it from the domains it is assigned to
+func (s *Store) Remove(certFile string, keyFile string) {
+	s.remove(pairKey(s.path(certFile), s.path(keyFile)))
+}
+
+func (s *Store) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pairs, key)
+
+	for domain, assigned := range s.assigned {
+		if assigned == key {
+			delete(s.assigned, domain)
+		}
+	}
+}
+
+// LoadDir adds every certificate of the store's directory, each *.crt
+// file is expected to have its key in a *.key file of the same name
+func (s *Store) LoadDir() error {
+	certFiles, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, certFile := range certFiles {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		if err := s.Add(certFile, keyFile); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", certFile, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Reload reloads the certificates whose files changed. A certificate
+// which can't be loaded anymore keeps being used, unless its files are
+// deleted, it is removed then.
+func (s *Store) Reload() error {
+	s.mu.RLock()
+	pairs := make([]*pair, 0, len(s.pairs))
+	for _, p := range s.pairs {
+		pairs = append(pairs, p)
+	}
+	s.mu.RUnlock()
+
+	var errs []error
+	for _, p := range pairs {
+		modTime, err := latestModTime(p.certFile, p.keyFile)
+		if errors.Is(err, os.ErrNotExist) {
+			s.remove(pairKey(p.certFile, p.keyFile))
+			errs = append(errs, fmt.Errorf("%s: %w, certificate removed", p.certFile, err))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if !modTime.After(p.modTime) {
+			continue
+		}
+
+		reloaded, err := loadPair(p.certFile, p.keyFile)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.certFile, err))
+			continue
+		}
+
+		key := pairKey(p.certFile, p.keyFile)
+
+		s.mu.Lock()
+		// it might have been removed in the meantime
+		if current, ok := s.pairs[key]; ok {
+			reloaded.added = current.added
+			s.pairs[key] = reloaded
+		}
+		s.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+// Watch reloads the certificates, and the directory if loadDir is set,
+// every interval until done is closed. Errors are passed to onError.
+func (s *Store) Watch(interval time.Duration, loadDir bool, done <-chan struct{}, onError func(error)) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(interval):
+		}
+
+		if loadDir {
+			if err := s.LoadDir(); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+
+		if err := s.Reload(); err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+// lookup returns the certificate of name: the one assigned to name, then the
+// one issued for name, then the ones assigned or issued for a wildcard of name.
+// If several certificates are issued for the same name, the one which expires
+// last is used, so a renewed certificate is preferred over the previous one.
+func (s *Store) lookup(name string) (*tls.Certificate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	candidates := []string{name}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		candidates = append(candidates, "*."+parent)
+	}
+
+	for _, candidate := range candidates {
+		if key, ok := s.assigned[candidate]; ok {
+			return s.pairs[key].cert, true
+		}
+
+		var latest *tls.Certificate
+		for _, p := range s.pairs {
+			for _, issued := range p.names {
+				if issued == candidate && (latest == nil || p.cert.Leaf.NotAfter.After(latest.Leaf.NotAfter)) {
+					latest = p.cert
+				}
+			}
+		}
+
+		if latest != nil {
+			return latest, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	if cert, ok := s.lookup(name); ok {
+		return cert, nil
+	}
+
+	s.mu.RLock()
+	fallback := s.fallback
+	s.mu.RUnlock()
+
+	if fallback == nil {
+		return nil, fmt.Errorf("%w for %q", ErrNoCertificate, name)
+	}
+
+	return fallback(hello)
+}
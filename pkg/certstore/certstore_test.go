@@ -0,0 +1,186 @@
+package certstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writePair writes a self-signed certificate for names as name.crt and name.key in dir
+func writePair(t *testing.T, dir string, name string, names ...string) {
+	t.Helper()
+	writePairUntil(t, dir, name, time.Now().Add(time.Hour), names...)
+}
+
+func writePairUntil(t *testing.T, dir string, name string, notAfter time.Time, names ...string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func issuedFor(t *testing.T, s *Store, serverName string) []string {
+	t.Helper()
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert.Leaf.DNSNames
+}
+
+func TestGetCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "wildcard", "*.corp.example.com")
+	writePair(t, dir, "api", "api.corp.example.com")
+	writePair(t, dir, "other", "other.example.com", "app.example.com")
+
+	s := New(dir)
+	assert.NoError(t, s.LoadDir())
+
+	// exact names are preferred over wildcards
+	assert.Equal(t, []string{"api.corp.example.com"}, issuedFor(t, s, "api.corp.example.com"))
+	assert.Equal(t, []string{"*.corp.example.com"}, issuedFor(t, s, "Web.Corp.Example.com"))
+
+	// wildcards only cover one label
+	_, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.b.corp.example.com"})
+	assert.ErrorIs(t, err, ErrNoCertificate)
+
+	// a certificate is assigned to a domain it covers
+	assert.NoError(t, s.Assign("api.corp.example.com", "wildcard.crt", "wildcard.key"))
+	assert.Equal(t, []string{"*.corp.example.com"}, issuedFor(t, s, "api.corp.example.com"))
+	assert.Error(t, s.Assign("example.com", "wildcard.crt", "wildcard.key"))
+
+	// the other names come from the fallback
+	fallback := &tls.Certificate{}
+	s.SetFallback(func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return fallback, nil
+	})
+
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	assert.NoError(t, err)
+	assert.Same(t, fallback, cert)
+}
+
+func TestLatestCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writePairUntil(t, dir, "renewed", time.Now().Add(90*24*time.Hour), "www.example.com", "renewed.example.com")
+	writePairUntil(t, dir, "expiring", time.Now().Add(time.Hour), "www.example.com", "expiring.example.com")
+
+	s := New(dir)
+	assert.NoError(t, s.LoadDir())
+
+	// the certificate which expires last is used
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, []string{"www.example.com", "renewed.example.com"}, issuedFor(t, s, "www.example.com"))
+	}
+}
+
+func TestUnassign(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "wildcard", "*.example.com")
+	writePair(t, dir, "api", "api.example.com")
+
+	s := New(dir)
+	assert.NoError(t, s.Add("api.crt", "api.key"))
+	assert.NoError(t, s.Assign("api.example.com", "wildcard.crt", "wildcard.key"))
+	assert.NoError(t, s.Assign("web.example.com", "wildcard.crt", "wildcard.key"))
+	assert.Equal(t, []string{"*.example.com"}, issuedFor(t, s, "api.example.com"))
+
+	// the added certificate is used again
+	s.Unassign("api.example.com")
+	assert.Equal(t, []string{"api.example.com"}, issuedFor(t, s, "api.example.com"))
+
+	// the assigned certificate is kept while assigned to another domain
+	assert.Equal(t, []string{"*.example.com"}, issuedFor(t, s, "app.example.com"))
+
+	s.Unassign("web.example.com")
+	_, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "app.example.com"})
+	assert.ErrorIs(t, err, ErrNoCertificate)
+
+	// added certificates are only removed explicitly
+	s.Remove("api.crt", "api.key")
+	_, err = s.GetCertificate(&tls.ClientHelloInfo{ServerName: "api.example.com"})
+	assert.ErrorIs(t, err, ErrNoCertificate)
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "site", "old.example.com")
+
+	s := New(dir)
+	assert.NoError(t, s.Add("site.crt", "site.key"))
+	assert.Equal(t, []string{"old.example.com"}, issuedFor(t, s, "old.example.com"))
+
+	// unchanged files are not reloaded
+	assert.NoError(t, s.Reload())
+
+	writePair(t, dir, "site", "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "site.crt"), later, later)
+
+	assert.NoError(t, s.Reload())
+	assert.Equal(t, []string{"new.example.com"}, issuedFor(t, s, "new.example.com"))
+
+	_, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "old.example.com"})
+	assert.ErrorIs(t, err, ErrNoCertificate)
+
+	// a broken certificate keeps the previous one
+	os.WriteFile(filepath.Join(dir, "site.key"), []byte("broken"), 0o600)
+	later = later.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "site.key"), later, later)
+
+	assert.Error(t, s.Reload())
+	assert.Equal(t, []string{"new.example.com"}, issuedFor(t, s, "new.example.com"))
+
+	// a deleted certificate is removed, and only reported once
+	os.Remove(filepath.Join(dir, "site.crt"))
+
+	assert.ErrorIs(t, s.Reload(), os.ErrNotExist)
+	assert.NoError(t, s.Reload())
+
+	_, err = s.GetCertificate(&tls.ClientHelloInfo{ServerName: "new.example.com"})
+	assert.ErrorIs(t, err, ErrNoCertificate)
+}
@@ -47,6 +47,17 @@ func (m *Map[T]) GetAndUpdate(key string, update func(old T, found bool) T) (val
 	return
 }
 
+func (m *Map[T]) Iterate(fn func(key string, val T) bool) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+
+	for key, val := range m.collection {
+		if !fn(key, val) {
+			break
+		}
+	}
+}
+
 func NewMap[T any]() *Map[T] {
 	return &Map[T]{
 		collection: make(map[string]T),
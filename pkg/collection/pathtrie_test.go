@@ -174,3 +174,48 @@ func TestMulti(t *testing.T) {
 		assert.Equal(t, 2, value)
 	}
 }
+
+func TestPathTrieParams(t *testing.T) {
+	testCases := []struct {
+		paths  []string
+		path   string
+		params collection.Params
+	}{
+		{
+			paths:  []string{"/users/:id"},
+			path:   "/users/42",
+			params: collection.Params{"id": "42"},
+		},
+		{
+			paths:  []string{"/users/:id/*rest"},
+			path:   "/users/42/posts/1",
+			params: collection.Params{"id": "42", "rest": "posts/1"},
+		},
+		{
+			paths:  []string{"/users/:id", "/users/:uid/posts/:pid"},
+			path:   "/users/7/posts/9",
+			params: collection.Params{"uid": "7", "pid": "9"},
+		},
+		{
+			paths:  []string{"/a/+/b/:name"},
+			path:   "/a/1/b/2",
+			params: collection.Params{"name": "2"},
+		},
+		{
+			paths:  []string{"/files*path"},
+			path:   "/files",
+			params: collection.Params{"path": ""},
+		},
+	}
+
+	for i, tc := range testCases {
+		pt := collection.NewTrie[bool]()
+		for _, path := range tc.paths {
+			pt.Put([]rune(path), true)
+		}
+
+		_, params, ok := pt.Match([]rune(tc.path))
+		assert.True(t, ok, "test case: %d, path: %s", i+1, tc.path)
+		assert.Equal(t, tc.params, params, "test case: %d, path: %s", i+1, tc.path)
+	}
+}
@@ -55,6 +55,17 @@ func (s *Slice[T]) Index(fn func(item T) bool) int {
 	return -1
 }
 
+func (s *Slice[T]) Iterate(fn func(item T) bool) {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	for _, item := range s.collection {
+		if !fn(item) {
+			break
+		}
+	}
+}
+
 func NewSlice[T any]() *Slice[T] {
 	return &Slice[T]{
 		collection: make([]T, 0),
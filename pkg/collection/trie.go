@@ -1,13 +1,19 @@
 package collection
 
 const (
-	plus rune = '+'
-	wild rune = '*'
-	path rune = '/'
+	plus  rune = '+'
+	wild  rune = '*'
+	path  rune = '/'
+	param rune = ':'
 )
 
+// Params holds the named segments captured while matching a path.
+// `:name` captures a single segment and `*name` captures the tail.
+type Params map[string]string
+
 type value[T any] struct {
 	content T
+	names   []string
 }
 
 type Trie[T any] struct {
@@ -15,13 +21,33 @@ type Trie[T any] struct {
 	children map[rune]*Trie[T]
 }
 
+// Put registers val under key. Besides the `+` and `*` wildcards, key may
+// contain named captures such as `/users/:id/*rest`. A `:name` segment is
+// stored as `+` and anything following `*` is the name of the tail capture.
 func (t *Trie[T]) Put(key []rune, val T) {
 	current := t
+	names := make([]string, 0)
 	i := 0
 
 	for i < len(key) {
 		r := key[i]
 
+		switch {
+		case r == param && (i == 0 || key[i-1] == path):
+			j := i + 1
+			for j < len(key) && key[j] != path {
+				j++
+			}
+			names = append(names, string(key[i+1:j]))
+			r = plus
+			i = j - 1
+		case r == plus:
+			names = append(names, "")
+		case r == wild:
+			names = append(names, string(key[i+1:]))
+			i = len(key) - 1
+		}
+
 		next, ok := current.children[r]
 		if !ok {
 			next = NewTrie[T]()
@@ -32,24 +58,30 @@ func (t *Trie[T]) Put(key []rune, val T) {
 		i++
 	}
 
-	if i != len(key) {
-		return
-	}
-
 	current.val = &value[T]{
 		content: val,
+		names:   names,
 	}
 }
 
 func (t *Trie[T]) Get(key []rune) (found T, ok bool) {
+	found, _, ok = t.Match(key)
+	return
+}
+
+// Match works like Get but also returns the segments captured by the
+// named wildcards of the matched key.
+func (t *Trie[T]) Match(key []rune) (found T, params Params, ok bool) {
 	current := t
+	captures := make([][2]int, 0)
 	i := 0
 	isPlus := false
 
 	for i < len(key) {
 		r := key[i]
-		if r == path {
+		if r == path && isPlus {
 			isPlus = false
+			captures[len(captures)-1][1] = i
 		}
 
 		if isPlus {
@@ -61,15 +93,18 @@ func (t *Trie[T]) Get(key []rune) (found T, ok bool) {
 		if !ok {
 			next, ok = current.children[wild]
 			if ok {
+				captures = append(captures, [2]int{i, len(key)})
 				current = next
+				i = len(key)
 				break
 			}
 
 			next, ok = current.children[plus]
 			if !ok {
-				return found, false
+				return found, nil, false
 			}
 			isPlus = true
+			captures = append(captures, [2]int{i, len(key)})
 		}
 
 		current = next
@@ -78,14 +113,23 @@ func (t *Trie[T]) Get(key []rune) (found T, ok bool) {
 
 	// need to check if the last node is a wildcard
 	if next, ok := current.children[wild]; ok {
+		captures = append(captures, [2]int{i, i})
 		current = next
 	}
 
 	if current.val == nil {
-		return found, false
+		return found, nil, false
+	}
+
+	params = make(Params)
+	for j, name := range current.val.names {
+		if name == "" || j >= len(captures) {
+			continue
+		}
+		params[name] = string(key[captures[j][0]:captures[j][1]])
 	}
 
-	return current.val.content, true
+	return current.val.content, params, true
 }
 
 func NewTrie[T any]() *Trie[T] {
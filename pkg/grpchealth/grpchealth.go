@@ -0,0 +1,157 @@
+// Package grpchealth implements the client side of the gRPC health checking
+// protocol, grpc.health.v1.Health/Check, without depending on gRPC.
+package grpchealth
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Status is the serving status of grpc.health.v1.HealthCheckResponse
+type Status int
+
+const (
+	StatusUnknown        Status = 0
+	StatusServing        Status = 1
+	StatusNotServing     Status = 2
+	StatusServiceUnknown Status = 3
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusServing:
+		return "SERVING"
+	case StatusNotServing:
+		return "NOT_SERVING"
+	case StatusServiceUnknown:
+		return "SERVICE_UNKNOWN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+var ErrInvalidResponse = errors.New("invalid health check response")
+
+// encodeRequest encodes a HealthCheckRequest, whose only field is
+// the service, as a length prefixed gRPC message
+func encodeRequest(service string) []byte {
+	var message []byte
+	if service != "" {
+		message = append(message, 0x0a)
+		message = binary.AppendUvarint(message, uint64(len(service)))
+		message = append(message, service...)
+	}
+
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+
+	return append(frame, message...)
+}
+
+// decodeResponse reads the status of a HealthCheckResponse,
+// unknown fields are skipped
+func decodeResponse(frame []byte) (Status, error) {
+	if len(frame) < 5 || frame[0] != 0 {
+		return StatusUnknown, ErrInvalidResponse
+	}
+
+	size := binary.BigEndian.Uint32(frame[1:5])
+	message := frame[5:]
+	if uint32(len(message)) < size {
+		return StatusUnknown, ErrInvalidResponse
+	}
+	message = message[:size]
+
+	status := StatusUnknown
+
+	for len(message) > 0 {
+		tag, n := binary.Uvarint(message)
+		if n <= 0 {
+			return StatusUnknown, ErrInvalidResponse
+		}
+		message = message[n:]
+
+		switch tag & 0x7 {
+		case 0:
+			value, n := binary.Uvarint(message)
+			if n <= 0 {
+				return StatusUnknown, ErrInvalidResponse
+			}
+			message = message[n:]
+
+			if tag>>3 == 1 {
+				status = Status(value)
+			}
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return StatusUnknown, ErrInvalidResponse
+			}
+			message = message[n+int(length):]
+		default:
+			return StatusUnknown, ErrInvalidResponse
+		}
+	}
+
+	return status, nil
+}
+
+// Check asks the gRPC server listening on addr for the status of service, an
+// empty service is the overall health of the server. client must speak HTTP/2,
+// e.g. using httpclient.H2C.
+func Check(ctx context.Context, client *http.Client, addr string, service string) (Status, error) {
+	target := &url.URL{
+		Scheme: "http",
+		Host:   addr,
+		Path:   "/grpc.health.v1.Health/Check",
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(encodeRequest(service)))
+	if err != nil {
+		return StatusUnknown, err
+	}
+
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return StatusUnknown, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return StatusUnknown, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return StatusUnknown, err
+	}
+
+	// errors are sent either in the trailers or, without
+	// a message, in the header
+	grpcStatus := resp.Trailer.Get("Grpc-Status")
+	grpcMessage := resp.Trailer.Get("Grpc-Message")
+	if grpcStatus == "" {
+		grpcStatus = resp.Header.Get("Grpc-Status")
+		grpcMessage = resp.Header.Get("Grpc-Message")
+	}
+
+	// NOT_FOUND is how servers report services they don't know
+	if grpcStatus == "5" {
+		return StatusServiceUnknown, nil
+	}
+
+	if grpcStatus != "0" {
+		return StatusUnknown, fmt.Errorf("grpc-status %s: %s", grpcStatus, grpcMessage)
+	}
+
+	return decodeResponse(body)
+}
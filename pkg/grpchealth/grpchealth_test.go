@@ -0,0 +1,82 @@
+package grpchealth
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alinz/baker.go/pkg/httpclient"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestCheck(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/grpc.health.v1.Health/Check", r.URL.Path)
+
+		frame, _ := io.ReadAll(r.Body)
+		service := ""
+		if len(frame) > 7 {
+			service = string(frame[7:])
+		}
+
+		w.Header().Set("Content-Type", "application/grpc")
+
+		switch service {
+		case "", "app":
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write([]byte{0, 0, 0, 0, 2, 0x08, byte(StatusServing)})
+			w.Header().Set("Grpc-Status", "0")
+		case "down":
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.Write([]byte{0, 0, 0, 0, 2, 0x08, byte(StatusNotServing)})
+			w.Header().Set("Grpc-Status", "0")
+		case "broken":
+			w.Header().Set("Grpc-Status", "13")
+			w.Header().Set("Grpc-Message", "broken")
+		default:
+			w.Header().Set("Grpc-Status", "5")
+		}
+	}), &http2.Server{}))
+	t.Cleanup(server.Close)
+
+	client := &http.Client{Transport: httpclient.H2C()}
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	check := func(service string) (Status, error) {
+		return Check(context.Background(), client, addr, service)
+	}
+
+	status, err := check("")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusServing, status)
+
+	status, err = check("app")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusServing, status)
+
+	status, err = check("down")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusNotServing, status)
+
+	status, err = check("unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, StatusServiceUnknown, status)
+
+	_, err = check("broken")
+	assert.EqualError(t, err, "grpc-status 13: broken")
+}
+
+func TestDecodeResponse(t *testing.T) {
+	// unknown fields are skipped
+	status, err := decodeResponse([]byte{0, 0, 0, 0, 6, 0x12, 0x02, 'o', 'k', 0x08, 0x01})
+	assert.NoError(t, err)
+	assert.Equal(t, StatusServing, status)
+
+	_, err = decodeResponse([]byte{0, 0, 0, 0, 4, 0x08})
+	assert.ErrorIs(t, err, ErrInvalidResponse)
+}
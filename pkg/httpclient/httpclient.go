@@ -2,10 +2,13 @@ package httpclient
 
 import (
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
 	"time"
+
+	"golang.org/x/net/http2"
 )
 
 type Getter interface {
@@ -51,3 +54,15 @@ func New() GetterFunc {
 		return resp.Body, nil
 	})
 }
+
+// H2C returns a transport which sends requests over HTTP/2 without TLS,
+// using prior knowledge, as expected by gRPC servers
+func H2C() http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
@@ -0,0 +1,217 @@
+// Package listener configures the addresses baker listens on, the timeouts and
+// limits of its http servers and its TLS settings.
+package listener
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/proxyproto"
+)
+
+type Config struct {
+	HTTPAddrs  []string
+	HTTPSAddrs []string
+
+	// MinTLSVersion is tls.VersionTLS12 by default
+	MinTLSVersion uint16
+	// CipherSuites only applies to TLS 1.2 and below, the defaults
+	// of crypto/tls are used if empty
+	CipherSuites []uint16
+	// ALPN lists the protocols negotiated with TLS clients, h2 and http/1.1 by
+	// default. http/1.1 is always accepted, HTTP/2 is disabled if h2 is not listed.
+	ALPN []string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+
+	// ProxyProtocol expects the PROXY protocol header, version 1 or 2,
+	// on every connection, as sent by load balancers
+	ProxyProtocol bool
+}
+
+// Default doesn't limit how long reading a request or writing a response takes,
+// so long downloads and streams are not interrupted, only slow headers are
+func Default() Config {
+	return Config{
+		HTTPAddrs:         []string{":80"},
+		HTTPSAddrs:        []string{":443"},
+		MinTLSVersion:     tls.VersionTLS12,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// FromEnv reads the config from the BAKER_* variables returned by getenv, e.g.
+// os.Getenv, anything which is not set keeps the value of Default
+func FromEnv(getenv func(string) string) (Config, error) {
+	c := Default()
+
+	if addrs := parseList(getenv("BAKER_HTTP_ADDRS")); len(addrs) > 0 {
+		c.HTTPAddrs = addrs
+	}
+
+	if addrs := parseList(getenv("BAKER_HTTPS_ADDRS")); len(addrs) > 0 {
+		c.HTTPSAddrs = addrs
+	}
+
+	if value := getenv("BAKER_TLS_MIN_VERSION"); value != "" {
+		version, ok := tlsVersions[value]
+		if !ok {
+			return c, fmt.Errorf("invalid BAKER_TLS_MIN_VERSION %q, expected 1.0, 1.1, 1.2 or 1.3", value)
+		}
+		c.MinTLSVersion = version
+	}
+
+	if names := parseList(getenv("BAKER_TLS_CIPHER_SUITES")); len(names) > 0 {
+		suites, err := parseCipherSuites(names)
+		if err != nil {
+			return c, fmt.Errorf("invalid BAKER_TLS_CIPHER_SUITES: %w", err)
+		}
+		c.CipherSuites = suites
+	}
+
+	c.ALPN = parseList(getenv("BAKER_TLS_ALPN"))
+
+	timeouts := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"BAKER_READ_HEADER_TIMEOUT", &c.ReadHeaderTimeout},
+		{"BAKER_READ_TIMEOUT", &c.ReadTimeout},
+		{"BAKER_WRITE_TIMEOUT", &c.WriteTimeout},
+		{"BAKER_IDLE_TIMEOUT", &c.IdleTimeout},
+	}
+
+	for _, timeout := range timeouts {
+		value := getenv(timeout.name)
+		if value == "" {
+			continue
+		}
+
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return c, fmt.Errorf("invalid %s %q", timeout.name, value)
+		}
+		*timeout.value = duration
+	}
+
+	if value := getenv("BAKER_MAX_HEADER_BYTES"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return c, fmt.Errorf("invalid BAKER_MAX_HEADER_BYTES %q", value)
+		}
+		c.MaxHeaderBytes = size
+	}
+
+	c.ProxyProtocol = strings.ToLower(getenv("BAKER_PROXY_PROTOCOL")) == "yes"
+
+	return c, nil
+}
+
+// Listen listens on the tcp address addr, expecting
+// the PROXY protocol if it is enabled
+func (c *Config) Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ProxyProtocol {
+		timeout := c.ReadHeaderTimeout
+		if timeout == 0 {
+			timeout = 10 * time.Second
+		}
+		l = proxyproto.NewListener(l, timeout)
+	}
+
+	return l, nil
+}
+
+// NewServer returns a server with the timeouts and limits of c
+func (c *Config) NewServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
+}
+
+// NewTLSServer returns a server as NewServer does, which
+// serves TLS with the certificates of getCertificate
+func (c *Config) NewTLSServer(handler http.Handler, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *http.Server {
+	server := c.NewServer(handler)
+	server.TLSConfig = c.TLSConfig(getCertificate)
+
+	// net/http always enables HTTP/2 unless told not to
+	if len(c.ALPN) > 0 && !contains(c.ALPN, "h2") {
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+
+	return server
+}
+
+// TLSConfig returns the TLS settings of c
+func (c *Config) TLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     c.MinTLSVersion,
+		CipherSuites:   c.CipherSuites,
+		NextProtos:     c.ALPN,
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package listener
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	c, err := FromEnv(env(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), c)
+
+	c, err = FromEnv(env(map[string]string{
+		"BAKER_HTTP_ADDRS":          ":8080, :8081",
+		"BAKER_HTTPS_ADDRS":         ":8443",
+		"BAKER_TLS_MIN_VERSION":     "1.3",
+		"BAKER_TLS_CIPHER_SUITES":   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"BAKER_TLS_ALPN":            "http/1.1",
+		"BAKER_READ_HEADER_TIMEOUT": "5s",
+		"BAKER_WRITE_TIMEOUT":       "1m",
+		"BAKER_MAX_HEADER_BYTES":    "8192",
+		"BAKER_PROXY_PROTOCOL":      "yes",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":8080", ":8081"}, c.HTTPAddrs)
+	assert.Equal(t, []string{":8443"}, c.HTTPSAddrs)
+	assert.Equal(t, uint16(tls.VersionTLS13), c.MinTLSVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, c.CipherSuites)
+	assert.Equal(t, []string{"http/1.1"}, c.ALPN)
+	assert.Equal(t, 5*time.Second, c.ReadHeaderTimeout)
+	assert.Equal(t, time.Duration(0), c.ReadTimeout)
+	assert.Equal(t, time.Minute, c.WriteTimeout)
+	assert.Equal(t, 8192, c.MaxHeaderBytes)
+	assert.True(t, c.ProxyProtocol)
+
+	invalid := []map[string]string{
+		{"BAKER_TLS_MIN_VERSION": "1.4"},
+		{"BAKER_TLS_CIPHER_SUITES": "TLS_RSA_WITH_RC4_128_SHA"},
+		{"BAKER_IDLE_TIMEOUT": "forever"},
+		{"BAKER_MAX_HEADER_BYTES": "-1"},
+	}
+
+	for _, values := range invalid {
+		_, err := FromEnv(env(values))
+		assert.Error(t, err, values)
+	}
+}
+
+func TestNewTLSServer(t *testing.T) {
+	handler := http.NotFoundHandler()
+
+	c := Default()
+	server := c.NewTLSServer(handler, nil)
+	assert.Nil(t, server.TLSNextProto)
+	assert.Equal(t, uint16(tls.VersionTLS12), server.TLSConfig.MinVersion)
+
+	// HTTP/2 is disabled
+	c.ALPN = []string{"http/1.1"}
+	server = c.NewTLSServer(handler, nil)
+	assert.NotNil(t, server.TLSNextProto)
+	assert.Empty(t, server.TLSNextProto)
+}
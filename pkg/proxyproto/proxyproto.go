@@ -0,0 +1,247 @@
+// Package proxyproto reads the PROXY protocol header, version 1 and 2, sent by
+// load balancers at the beginning of each connection to pass the address of
+// the client, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidHeader = errors.New("invalid proxy protocol header")
+
+var signatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const maxHeaderV1 = 107
+
+// Listener expects the PROXY protocol header on each accepted connection, the
+// header is read on the first use of the connection, so Accept is not blocked
+type Listener struct {
+	net.Listener
+	// Timeout is how long the client has to send the header
+	Timeout time.Duration
+}
+
+func NewListener(l net.Listener, timeout time.Duration) *Listener {
+	return &Listener{Listener: l, Timeout: timeout}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: l.Timeout,
+	}, nil
+}
+
+// Conn reports the addresses sent in the header as its remote and local
+// addresses, or the ones of the connection if the header doesn't have any,
+// e.g. for the health checks of the load balancer
+type Conn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *Conn) init() error {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+
+		c.remoteAddr, c.localAddr, c.err = readHeader(c.reader)
+		if c.err != nil {
+			c.Conn.Close()
+		}
+	})
+
+	return c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.init() == nil && c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	if c.init() == nil && c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite closes the writing side of the connection, if supported
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// readHeader reads either version of the header, the addresses
+// are nil if the header doesn't carry any
+func readHeader(r *bufio.Reader) (remote net.Addr, local net.Addr, err error) {
+	peeked, err := r.Peek(len(signatureV2))
+	if err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	if bytes.Equal(peeked, signatureV2) {
+		return readV2(r)
+	}
+
+	if bytes.HasPrefix(peeked, []byte("PROXY ")) {
+		return readV1(r)
+	}
+
+	return nil, nil, ErrInvalidHeader
+}
+
+// readV1 reads a header such as "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, ErrInvalidHeader
+		}
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxHeaderV1 {
+			return nil, nil, ErrInvalidHeader
+		}
+	}
+
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	remote, err := parseAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	local, err := parseAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return remote, local, nil
+}
+
+func parseAddr(ip string, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+const (
+	commandLocal = 0x0
+	commandProxy = 0x1
+
+	familyTCP4 = 0x11
+	familyTCP6 = 0x21
+)
+
+// readV2 reads the binary header, the TLVs following the addresses are skipped
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, header[12]>>4)
+	}
+
+	command := header[12] & 0xf
+	family := header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	switch command {
+	case commandLocal:
+		return nil, nil, nil
+	case commandProxy:
+	default:
+		return nil, nil, ErrInvalidHeader
+	}
+
+	var size int
+	switch family {
+	case familyTCP4:
+		size = net.IPv4len
+	case familyTCP6:
+		size = net.IPv6len
+	default:
+		// e.g. unix sockets, the addresses are not relevant
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	srcIP, _ := netip.AddrFromSlice(payload[:size])
+	dstIP, _ := netip.AddrFromSlice(payload[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(payload[2*size:])
+	dstPort := binary.BigEndian.Uint16(payload[2*size+2:])
+
+	remote := net.TCPAddrFromAddrPort(netip.AddrPortFrom(srcIP, srcPort))
+	local := net.TCPAddrFromAddrPort(netip.AddrPortFrom(dstIP, dstPort))
+
+	return remote, local, nil
+}
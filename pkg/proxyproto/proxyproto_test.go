@@ -0,0 +1,91 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func accept(t *testing.T, header []byte, payload string) (net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write(header)
+		conn.Write([]byte(payload))
+	}()
+
+	conn, err := NewListener(l, time.Second).Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn, conn.(*Conn).init()
+}
+
+func TestV1(t *testing.T) {
+	conn, err := accept(t, []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"), "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "10.0.0.1:443", conn.LocalAddr().String())
+
+	body, _ := io.ReadAll(conn)
+	assert.Equal(t, "hello", string(body))
+
+	conn, err = accept(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+
+	// the load balancer doesn't know the client
+	conn, err = accept(t, []byte("PROXY UNKNOWN\r\n"), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+}
+
+func TestV2(t *testing.T) {
+	header := append([]byte{}, signatureV2...)
+	header = append(header, 0x21, familyTCP4)
+	header = binary.BigEndian.AppendUint16(header, 12+3)
+	header = append(header, 192, 168, 0, 1, 10, 0, 0, 1)
+	header = binary.BigEndian.AppendUint16(header, 56324)
+	header = binary.BigEndian.AppendUint16(header, 443)
+	// a TLV, which is skipped
+	header = append(header, 0x04, 0x00, 0x00)
+
+	conn, err := accept(t, header, "hello")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	assert.Equal(t, "10.0.0.1:443", conn.LocalAddr().String())
+
+	body, _ := io.ReadAll(conn)
+	assert.Equal(t, "hello", string(body))
+
+	// the health checks of the load balancer
+	local := append([]byte{}, signatureV2...)
+	local = append(local, 0x20, 0x00, 0x00, 0x00)
+
+	conn, err = accept(t, local, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", conn.RemoteAddr().(*net.TCPAddr).IP.String())
+}
+
+func TestInvalid(t *testing.T) {
+	_, err := accept(t, []byte("GET / HTTP/1.1\r\n\r\n"), "")
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+
+	_, err = accept(t, []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n"), "")
+	assert.ErrorIs(t, err, ErrInvalidHeader)
+}
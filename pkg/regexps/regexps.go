@@ -0,0 +1,85 @@
+// Package regexps compiles the regular expressions of endpoints and rules
+// once, as their configs are decoded again every time containers are pinged.
+// The least recently used expressions are evicted, so the ones of removed
+// containers don't stay in memory.
+package regexps
+
+import (
+	"container/list"
+	"regexp"
+	"sync"
+)
+
+// DefaultSize is the number of expressions kept by Compile
+const DefaultSize = 1024
+
+type entry struct {
+	expr string
+	re   *regexp.Regexp
+}
+
+// Cache keeps up to size compiled expressions
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func New(size int) *Cache {
+	return &Cache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Compile returns the compiled expr, compiling it if it isn't cached
+func (c *Cache) Compile(expr string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[expr]; ok {
+		c.order.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*entry).re, nil
+	}
+	c.mu.Unlock()
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// compiled concurrently
+	if elem, ok := c.entries[expr]; ok {
+		c.order.MoveToFront(elem)
+		return elem.Value.(*entry).re, nil
+	}
+
+	c.entries[expr] = c.order.PushFront(&entry{expr: expr, re: re})
+
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).expr)
+	}
+
+	return re, nil
+}
+
+// Len returns the number of cached expressions
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
+
+var shared = New(DefaultSize)
+
+// Compile compiles expr using the cache shared by baker and its rules
+func Compile(expr string) (*regexp.Regexp, error) {
+	return shared.Compile(expr)
+}
@@ -0,0 +1,36 @@
+package regexps
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompile(t *testing.T) {
+	c := New(2)
+
+	a, err := c.Compile("^a+$")
+	assert.NoError(t, err)
+
+	again, err := c.Compile("^a+$")
+	assert.NoError(t, err)
+	assert.Same(t, a, again)
+
+	_, err = c.Compile("(")
+	assert.Error(t, err)
+	assert.Equal(t, 1, c.Len())
+
+	// b is evicted, a being used more recently
+	c.Compile("^b+$")
+	c.Compile("^a+$")
+	c.Compile("^c+$")
+	assert.Equal(t, 2, c.Len())
+
+	again, _ = c.Compile("^a+$")
+	assert.Same(t, a, again)
+
+	c.mu.Lock()
+	_, ok := c.entries["^b+$"]
+	c.mu.Unlock()
+	assert.False(t, ok)
+}
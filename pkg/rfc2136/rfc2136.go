@@ -0,0 +1,143 @@
+// Package rfc2136 publishes the TXT records of ACME DNS-01 challenges using
+// DNS dynamic updates (RFC 2136), as supported by BIND, Knot or PowerDNS.
+package rfc2136
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Provider sends the updates to Nameserver, signed using TSIG if TSIGKey is set
+type Provider struct {
+	// Nameserver is the address of the primary server of the zone, e.g. 10.0.0.53:53
+	Nameserver string
+	// Zone receives the updates, e.g. example.com, it is looked up using the
+	// SOA records of the nameserver if empty
+	Zone string
+	// TSIGKey is the name of the key, TSIGSecret its base64 encoded secret
+	TSIGKey    string
+	TSIGSecret string
+	// TSIGAlgorithm is hmac-sha256 by default
+	TSIGAlgorithm string
+	// TTL of the records, 60 seconds by default
+	TTL time.Duration
+	// Timeout of each update, 10 seconds by default
+	Timeout time.Duration
+}
+
+var ErrZoneNotFound = errors.New("zone not found")
+
+// Present adds the TXT record fqdn, e.g. _acme-challenge.example.com.
+func (p *Provider) Present(ctx context.Context, fqdn string, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+// CleanUp removes the TXT record added by Present
+func (p *Provider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+func (p *Provider) client() *dns.Client {
+	c := &dns.Client{Net: "tcp", Timeout: p.Timeout}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	if p.TSIGKey != "" {
+		c.TsigSecret = map[string]string{dns.Fqdn(p.TSIGKey): p.TSIGSecret}
+	}
+
+	return c
+}
+
+func (p *Provider) sign(m *dns.Msg) {
+	if p.TSIGKey == "" {
+		return
+	}
+
+	algorithm := p.TSIGAlgorithm
+	if algorithm == "" {
+		algorithm = dns.HmacSHA256
+	}
+
+	m.SetTsig(dns.Fqdn(p.TSIGKey), dns.Fqdn(algorithm), 300, time.Now().Unix())
+}
+
+func (p *Provider) update(ctx context.Context, fqdn string, value string, insert bool) error {
+	fqdn = dns.Fqdn(fqdn)
+
+	zone := p.Zone
+	if zone == "" {
+		var err error
+		if zone, err = p.findZone(ctx, fqdn); err != nil {
+			return err
+		}
+	}
+
+	ttl := p.TTL
+	if ttl == 0 {
+		ttl = 60 * time.Second
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   fqdn,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(ttl.Seconds()),
+		},
+		Txt: []string{value},
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	if insert {
+		m.Insert([]dns.RR{rr})
+	} else {
+		m.Remove([]dns.RR{rr})
+	}
+	p.sign(m)
+
+	reply, _, err := p.client().ExchangeContext(ctx, m, p.Nameserver)
+	if err != nil {
+		return err
+	}
+
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rfc2136: update of %s refused: %s", fqdn, dns.RcodeToString[reply.Rcode])
+	}
+
+	return nil
+}
+
+// findZone asks the nameserver for the SOA of each parent of fqdn,
+// the first one it is authoritative for is the zone
+func (p *Provider) findZone(ctx context.Context, fqdn string) (string, error) {
+	c := p.client()
+
+	for name := fqdn; name != "."; {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeSOA)
+
+		reply, _, err := c.ExchangeContext(ctx, m, p.Nameserver)
+		if err != nil {
+			return "", err
+		}
+
+		for _, rr := range reply.Answer {
+			if soa, ok := rr.(*dns.SOA); ok && strings.EqualFold(soa.Hdr.Name, name) {
+				return name, nil
+			}
+		}
+
+		_, parent, _ := strings.Cut(name, ".")
+		name = dns.Fqdn(parent)
+	}
+
+	return "", fmt.Errorf("rfc2136: %w for %s", ErrZoneNotFound, fqdn)
+}
@@ -0,0 +1,106 @@
+package rfc2136
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	tsigKey    = "baker."
+	tsigSecret = "c2VjcmV0LXNlY3JldC1zZWNyZXQ="
+)
+
+// startServer starts a nameserver authoritative for example.com, which
+// applies the signed updates to records
+func startServer(t *testing.T) (addr string, records func() []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	txt := make(map[string]bool)
+
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		switch r.Opcode {
+		case dns.OpcodeQuery:
+			if r.Question[0].Name == "example.com." {
+				soa, _ := dns.NewRR("example.com. 60 IN SOA ns.example.com. admin.example.com. 1 60 60 60 60")
+				m.Answer = append(m.Answer, soa)
+			}
+		case dns.OpcodeUpdate:
+			if r.IsTsig() == nil || w.TsigStatus() != nil || r.Question[0].Name != "example.com." {
+				m.Rcode = dns.RcodeRefused
+				break
+			}
+
+			mu.Lock()
+			for _, rr := range r.Ns {
+				record := rr.Header().Name + " " + rr.(*dns.TXT).Txt[0]
+				txt[record] = rr.Header().Class == dns.ClassINET
+			}
+			mu.Unlock()
+
+			m.SetTsig(tsigKey, dns.HmacSHA256, 300, int64(r.IsTsig().TimeSigned))
+		}
+
+		w.WriteMsg(m)
+	})
+
+	server := &dns.Server{
+		Listener:   l,
+		Handler:    handler,
+		TsigSecret: map[string]string{tsigKey: tsigSecret},
+		// updates are rejected by default
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return l.Addr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var present []string
+		for record, ok := range txt {
+			if ok {
+				present = append(present, record)
+			}
+		}
+		return present
+	}
+}
+
+func TestProvider(t *testing.T) {
+	addr, records := startServer(t)
+
+	p := &Provider{
+		Nameserver: addr,
+		TSIGKey:    "baker",
+		TSIGSecret: tsigSecret,
+	}
+
+	ctx := context.Background()
+
+	// the zone is found using the SOA records
+	assert.NoError(t, p.Present(ctx, "_acme-challenge.www.example.com", "token"))
+	assert.Equal(t, []string{"_acme-challenge.www.example.com. token"}, records())
+
+	assert.NoError(t, p.CleanUp(ctx, "_acme-challenge.www.example.com.", "token"))
+	assert.Empty(t, records())
+
+	// unsigned updates are refused
+	unsigned := &Provider{Nameserver: addr, Zone: "example.com"}
+	assert.EqualError(t, unsigned.Present(ctx, "_acme-challenge.example.com", "token"), "rfc2136: update of _acme-challenge.example.com. refused: REFUSED")
+
+	unknown := &Provider{Nameserver: addr}
+	assert.ErrorIs(t, unknown.Present(ctx, "_acme-challenge.example.org", "token"), ErrZoneNotFound)
+}
@@ -0,0 +1,86 @@
+// Package sni reads the server name of TLS connections without terminating them.
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var errPeeked = errors.New("client hello peeked")
+
+// Conn replays the bytes read while peeking the ClientHello, so the
+// connection can be proxied or handed to a TLS server as is
+type Conn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// recordingConn only reads, and keeps what it reads
+type recordingConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// Peek returns the server name sent by the client in its ClientHello, empty if
+// the client doesn't send any, and the connection to use instead of conn. The
+// ClientHello must be received within timeout.
+func Peek(conn net.Conn, timeout time.Duration) (string, *Conn, error) {
+	var recorded bytes.Buffer
+	var serverName string
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return "", nil, err
+	}
+
+	recording := &recordingConn{
+		Conn:   conn,
+		reader: io.TeeReader(conn, &recorded),
+	}
+
+	// the handshake stops as soon as the ClientHello is parsed
+	err := tls.Server(recording, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errPeeked
+		},
+	}).Handshake()
+
+	peeked := &Conn{
+		Conn:   conn,
+		reader: io.MultiReader(&recorded, conn),
+	}
+
+	if !errors.Is(err, errPeeked) {
+		return "", peeked, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", peeked, err
+	}
+
+	return serverName, peeked, nil
+}
+
+// CloseWrite closes the writing side of the connection, if supported
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
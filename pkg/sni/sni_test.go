@@ -0,0 +1,43 @@
+package sni
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeek(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go tls.Client(client, &tls.Config{ServerName: "db.example.com", InsecureSkipVerify: true}).Handshake()
+
+	serverName, conn, err := Peek(server, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "db.example.com", serverName)
+
+	// the ClientHello is read again
+	header := make([]byte, 5)
+	_, err = io.ReadFull(conn, header)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x16), header[0])
+
+	conn.Close()
+}
+
+func TestPeekNotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	serverName, conn, err := Peek(server, time.Second)
+	assert.Error(t, err)
+	assert.Equal(t, "", serverName)
+
+	conn.Close()
+}
@@ -0,0 +1,391 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	BasicAuthName = "BasicAuth"
+	APIKeyName    = "APIKey"
+)
+
+const defaultRealm = "baker"
+
+func unauthorized(w http.ResponseWriter, r *http.Request, challenge string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	Error(w, r, http.StatusUnauthorized, "unauthorized")
+}
+
+func realm(realm string) string {
+	if realm == "" {
+		return defaultRealm
+	}
+	return realm
+}
+
+// argsKey is used by cachable middlewares to detect if their args are changed
+func argsKey(args any) string {
+	b, _ := json.Marshal(args)
+	return string(b)
+}
+
+// maxVerifiedCredentials bounds the number of verified credentials kept in memory,
+// once it is reached, the cache is cleared
+const maxVerifiedCredentials = 1024
+
+// BasicAuth authenticates requests using HTTP Basic authentication. Users maps
+// usernames to bcrypt hashes, more users can be loaded from an htpasswd file
+// which only contains bcrypt hashes, it is reloaded once it is modified, see
+// Reloader. If UserHeader is set, the authenticated username is forwarded to
+// the container using that header.
+type BasicAuth struct {
+	Users        map[string]string `json:"users"`
+	HtpasswdFile string            `json:"htpasswd_file"`
+	Realm        string            `json:"realm"`
+	UserHeader   string            `json:"user_header"`
+	users        map[string][]byte
+	modTime      time.Time
+	verified     map[[32]byte]struct{}
+	mu           sync.Mutex
+}
+
+var (
+	_ Middleware = (*BasicAuth)(nil)
+	_ Reloader   = (*BasicAuth)(nil)
+)
+
+// BasicAuth is cachable, so the htpasswd file is only loaded once and
+// bcrypt, which is slow by design, doesn't run for every request
+func (b *BasicAuth) IsCachable() bool {
+	return true
+}
+
+func (b *BasicAuth) UpdateMiddelware(newImpl Middleware) Middleware {
+	if newImpl == nil {
+		b.load()
+		return b
+	}
+
+	newB, ok := newImpl.(*BasicAuth)
+	if !ok {
+		log.Error().
+			Str("type", BasicAuthName).
+			Msg("failed to update middleware")
+		return b
+	}
+
+	if argsKey(b) == argsKey(newB) && b.isLoaded() {
+		return b
+	}
+
+	log.Debug().
+		Str("type", BasicAuthName).
+		Msg("updating middleware")
+
+	newB.load()
+	return newB
+}
+
+func (b *BasicAuth) isLoaded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.users != nil
+}
+
+func (b *BasicAuth) load() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.read()
+}
+
+// Reload reads the htpasswd file again if it is modified, the verified
+// credentials are forgotten once the users change
+func (b *BasicAuth) Reload() {
+	if b.HtpasswdFile == "" {
+		return
+	}
+
+	info, err := os.Stat(b.HtpasswdFile)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil && b.users != nil && info.ModTime().Equal(b.modTime) {
+		return
+	}
+
+	b.read()
+}
+
+// read sets the users, and forgets the verified credentials if they changed,
+// if the htpasswd file can't be read, the previous users are kept
+func (b *BasicAuth) read() {
+	users := make(map[string][]byte)
+
+	for username, hash := range b.Users {
+		users[username] = []byte(hash)
+	}
+
+	if b.HtpasswdFile != "" {
+		modTime, err := readHtpasswd(b.HtpasswdFile, users)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("type", BasicAuthName).
+				Str("path", b.HtpasswdFile).
+				Msg("failed to load htpasswd file")
+
+			if b.users != nil {
+				return
+			}
+		}
+		b.modTime = modTime
+	}
+
+	if b.users != nil && sameUsers(b.users, users) {
+		return
+	}
+
+	b.users = users
+	b.verified = make(map[[32]byte]struct{})
+}
+
+func readHtpasswd(path string, users map[string][]byte) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		users[username] = []byte(hash)
+	}
+
+	return info.ModTime(), scanner.Err()
+}
+
+func sameUsers(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for username, hash := range a {
+		if other, ok := b[username]; !ok || !bytes.Equal(hash, other) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *BasicAuth) authenticate(username, password string) bool {
+	key := sha256.Sum256([]byte(username + ":" + password))
+
+	b.mu.Lock()
+	hash, ok := b.users[username]
+	_, verified := b.verified[key]
+	b.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	b.mu.Lock()
+	// the users might have changed while verifying
+	if current, ok := b.users[username]; ok && bytes.Equal(current, hash) {
+		if len(b.verified) >= maxVerifiedCredentials {
+			b.verified = make(map[[32]byte]struct{})
+		}
+		b.verified[key] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	return true
+}
+
+func (b *BasicAuth) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || !b.authenticate(username, password) {
+			unauthorized(w, r, fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm(b.Realm)))
+			return
+		}
+
+		if b.UserHeader != "" {
+			r.Header.Set(b.UserHeader, username)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NewBasicAuth(users map[string]string, realm string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: BasicAuthName,
+		Args: &BasicAuth{
+			Users: users,
+			Realm: realm,
+		},
+	}
+}
+
+func RegisterBasicAuth() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[BasicAuthName] = func(raw json.RawMessage) (Middleware, error) {
+			basicAuth := &BasicAuth{}
+			err := json.Unmarshal(raw, basicAuth)
+			if err != nil {
+				return nil, err
+			}
+			return basicAuth, nil
+		}
+
+		return nil
+	}
+}
+
+// APIKey authenticates requests using static keys sent in a header, `X-API-Key`
+// by default, or in a query parameter if Query is set. Keys maps the name of a
+// client to its key. If ClientHeader is set, the name of the authenticated client
+// is forwarded to the container using that header.
+type APIKey struct {
+	Keys         map[string]string `json:"keys"`
+	Header       string            `json:"header"`
+	Query        string            `json:"query"`
+	Realm        string            `json:"realm"`
+	ClientHeader string            `json:"client_header"`
+}
+
+var _ Middleware = (*APIKey)(nil)
+
+func (a *APIKey) IsCachable() bool {
+	return false
+}
+
+func (a *APIKey) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (a *APIKey) key(r *http.Request) string {
+	if a.Query != "" {
+		if key := r.URL.Query().Get(a.Query); key != "" {
+			return key
+		}
+	}
+
+	header := a.Header
+	if header == "" {
+		header = "X-API-Key"
+	}
+
+	return r.Header.Get(header)
+}
+
+// client returns the name of the client which owns key, all keys are compared,
+// so the time it takes doesn't depend on which key matched
+func (a *APIKey) client(key string) (string, bool) {
+	var client string
+	found := 0
+
+	for name, candidate := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			client = name
+			found = 1
+		}
+	}
+
+	return client, found == 1
+}
+
+func (a *APIKey) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := a.key(r)
+
+		client, ok := a.client(key)
+		if key == "" || !ok {
+			unauthorized(w, r, fmt.Sprintf(`APIKey realm=%q`, realm(a.Realm)))
+			return
+		}
+
+		if a.ClientHeader != "" {
+			r.Header.Set(a.ClientHeader, client)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NewAPIKey(keys map[string]string, header string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: APIKeyName,
+		Args: APIKey{
+			Keys:   keys,
+			Header: header,
+		},
+	}
+}
+
+func RegisterAPIKey() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[APIKeyName] = func(raw json.RawMessage) (Middleware, error) {
+			apiKey := &APIKey{}
+			err := json.Unmarshal(raw, apiKey)
+			if err != nil {
+				return nil, err
+			}
+			return apiKey, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,675 @@
+package rule
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+	"github.com/alinz/baker.go/rule/internal/cache"
+)
+
+const CacheName = "Cache"
+
+// CacheStatusHeader tells the client how the response was served:
+// HIT, STALE, REVALIDATED, MISS or BYPASS
+const CacheStatusHeader = "X-Baker-Cache"
+
+const (
+	defaultCacheMaxSize      = 64 << 20
+	defaultCacheMaxEntrySize = 1 << 20
+	defaultCacheMaxDiskSize  = 1 << 30
+)
+
+// cacheableStatusCodes can be stored, as defined by RFC 9110
+var cacheableStatusCodes = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// hopHeaders are not stored, they only apply to a single connection
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Trailer",
+	"Te",
+	CacheStatusHeader,
+}
+
+// Purger is implemented by rules which keep responses, so they can be purged
+// using the admin API. An empty domain or path matches everything.
+type Purger interface {
+	Purge(domain string, path string) int
+}
+
+// Cache keeps the responses of GET requests in memory, up to MaxSize bytes, and
+// on disk if DiskPath is set. Responses are keyed by host, path, query and the
+// request headers listed in Vary. Freshness follows Cache-Control and Expires,
+// DefaultTTL is used for responses which have neither. Stale responses are
+// revalidated using ETag and Last-Modified, and served while they are revalidated
+// in the background for the stale-while-revalidate window of the response, or
+// StaleWhileRevalidate by default. Requests with Authorization are not cached,
+// nor are requests with cookies, unless the response is public or varies on
+// Cookie. Cache must come after the rules which authenticate or filter requests,
+// e.g. APIKey, IPFilter or ForwardAuth, the cached responses skip them otherwise.
+type Cache struct {
+	MaxSize              int64    `json:"max_size"`
+	MaxEntrySize         int64    `json:"max_entry_size"`
+	DiskPath             string   `json:"disk_path"`
+	MaxDiskSize          int64    `json:"max_disk_size"`
+	DefaultTTL           Duration `json:"default_ttl"`
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+	store                *cache.Store
+	revalidating         sync.Map
+}
+
+var _ Middleware = (*Cache)(nil)
+var _ Purger = (*Cache)(nil)
+
+// Cache is cachable, so the stored responses survive the pinger updates
+func (c *Cache) IsCachable() bool {
+	return true
+}
+
+func (c *Cache) storeKey() string {
+	return argsKey([]any{c.MaxSize, c.DiskPath, c.MaxDiskSize})
+}
+
+func (c *Cache) UpdateMiddelware(newImpl Middleware) Middleware {
+	if newImpl == nil {
+		c.init()
+		return c
+	}
+
+	newC, ok := newImpl.(*Cache)
+	if !ok {
+		log.Error().
+			Str("type", CacheName).
+			Msg("failed to update middleware")
+		return c
+	}
+
+	if argsKey(c) == argsKey(newC) && c.store != nil {
+		return c
+	}
+
+	log.Debug().
+		Str("type", CacheName).
+		Msg("updating middleware")
+
+	// the stored responses are kept, unless the storage is changed
+	if c.storeKey() == newC.storeKey() && c.store != nil {
+		newC.store = c.store
+		return newC
+	}
+
+	newC.init()
+	return newC
+}
+
+func (c *Cache) init() {
+	store, err := cache.NewStore(c.MaxSize, c.DiskPath, c.MaxDiskSize)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("type", CacheName).
+			Str("path", c.DiskPath).
+			Msg("failed to open disk cache, using memory only")
+
+		store, _ = cache.NewStore(c.MaxSize, "", 0)
+	}
+
+	c.store = store
+}
+
+// Purge removes the responses of domain whose path starts with path
+func (c *Cache) Purge(domain string, path string) int {
+	if c.store == nil {
+		return 0
+	}
+
+	return c.store.Purge(func(key string) bool {
+		host, uri, _ := strings.Cut(key, " ")
+		if domain != "" && !strings.EqualFold(host, domain) && !strings.EqualFold(hostname(host), domain) {
+			return false
+		}
+		return strings.HasPrefix(uri, path)
+	})
+}
+
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return host
+}
+
+func cacheKey(r *http.Request) string {
+	return strings.ToLower(r.Host) + " " + r.URL.RequestURI()
+}
+
+// variantKey adds the values of the Vary headers of the request to key
+func variantKey(key string, vary []string, r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(key)
+
+	for _, name := range vary {
+		sb.WriteString("\n")
+		sb.WriteString(name)
+		sb.WriteString(":")
+		sb.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+
+	return sb.String()
+}
+
+func (c *Cache) lookup(key string, r *http.Request) (*cache.Entry, string, bool) {
+	entry, ok := c.store.Get(key)
+	if !ok || entry.Vary == nil {
+		return entry, key, ok && sharedWith(r, entry.Header, nil)
+	}
+
+	vary := entry.Vary
+	key = variantKey(key, vary, r)
+	entry, ok = c.store.Get(key)
+	return entry, key, ok && sharedWith(r, entry.Header, vary)
+}
+
+// sharedWith reports whether a response can be served to, or stored from, r.
+// Responses to requests with cookies are likely rendered for a session, they
+// are only shared if they are public, or vary on the cookies.
+func sharedWith(r *http.Request, header http.Header, vary []string) bool {
+	if r.Header.Get("Cookie") == "" {
+		return true
+	}
+
+	if cache.ParseControl(header.Values("Cache-Control")).Has("public") {
+		return true
+	}
+
+	for _, name := range vary {
+		if name == "Cookie" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Cache) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.store == nil ||
+			(r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+			r.Header.Get("Authorization") != "" ||
+			r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		control := cache.ParseControl(r.Header.Values("Cache-Control"))
+		if control.Has("no-store") {
+			w.Header().Set(CacheStatusHeader, "BYPASS")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now()
+		key := cacheKey(r)
+
+		entry, variant, ok := c.lookup(key, r)
+		if !ok {
+			// HEAD requests are served from the cache, but never stored
+			if r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c.fetch(w, r, next, key, nil)
+			return
+		}
+
+		maxAge, hasMaxAge := control.Duration("max-age")
+		revalidate := control.Has("no-cache") || (hasMaxAge && entry.Age(now) > maxAge)
+
+		switch {
+		case !revalidate && entry.IsFresh(now):
+			c.serve(w, r, entry, "HIT")
+		case !revalidate && entry.CanServeStale(now):
+			c.serve(w, r, entry, "STALE")
+			c.revalidate(next, r, key, variant, entry)
+		case r.Method == http.MethodHead:
+			next.ServeHTTP(w, r)
+		default:
+			c.fetch(w, r, next, key, entry)
+		}
+	})
+}
+
+func (c *Cache) serve(w http.ResponseWriter, r *http.Request, entry *cache.Entry, status string) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string(nil), values...)
+	}
+
+	header.Set("Age", strconv.FormatInt(int64(entry.Age(time.Now())/time.Second), 10))
+	header.Set(CacheStatusHeader, status)
+
+	if entry.StatusCode == http.StatusOK && notModified(r, entry.Header) {
+		header.Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.StatusCode)
+
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// notModified evaluates the conditional headers of the client against a stored response
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+
+	return !lastModified.After(ims)
+}
+
+// conditional returns a copy of r, which revalidates entry unless
+// the client sent its own conditional headers
+func conditional(ctx context.Context, r *http.Request, entry *cache.Entry) (*http.Request, bool) {
+	if entry == nil || !entry.HasValidators() ||
+		r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return r.Clone(ctx), false
+	}
+
+	req := r.Clone(ctx)
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := entry.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	return req, true
+}
+
+// fetch sends the request to the container, the response is streamed to the
+// client and stored if possible. If stale is revalidated, it is served instead.
+func (c *Cache) fetch(w http.ResponseWriter, r *http.Request, next http.Handler, key string, stale *cache.Entry) {
+	req, revalidating := conditional(r.Context(), r, stale)
+
+	cw := newCacheWriter(w, c.MaxEntrySize, revalidating)
+	next.ServeHTTP(cw, req)
+
+	if cw.notModified {
+		entry := c.refresh(stale, cw.header)
+		c.put(key, nil, r, entry)
+		c.serve(w, r, entry, "REVALIDATED")
+		return
+	}
+
+	c.save(key, r, cw)
+}
+
+func (c *Cache) save(key string, r *http.Request, cw *cacheWriter) {
+	entry, vary, ok := c.newEntry(cw)
+	if !ok || !sharedWith(r, entry.Header, vary) {
+		return
+	}
+
+	c.put(key, vary, r, entry)
+}
+
+// revalidate refreshes a stale entry in the background, only
+// one revalidation runs at a time for each entry
+func (c *Cache) revalidate(next http.Handler, r *http.Request, key string, variant string, stale *cache.Entry) {
+	if _, loaded := c.revalidating.LoadOrStore(variant, struct{}{}); loaded {
+		return
+	}
+
+	req, revalidating := conditional(context.WithoutCancel(r.Context()), r, stale)
+
+	go func() {
+		defer c.revalidating.Delete(variant)
+
+		cw := newCacheWriter(&discardResponseWriter{header: make(http.Header)}, c.MaxEntrySize, revalidating)
+		next.ServeHTTP(cw, req)
+
+		if cw.notModified {
+			c.put(key, nil, req, c.refresh(stale, cw.header))
+			return
+		}
+
+		c.save(key, req, cw)
+	}()
+}
+
+// refresh returns a copy of stale, updated with the header
+// of a 304 Not Modified response
+func (c *Cache) refresh(stale *cache.Entry, header http.Header) *cache.Entry {
+	entry := *stale
+	entry.Header = stale.Header.Clone()
+
+	for name, values := range header {
+		if name == "Content-Length" {
+			continue
+		}
+		entry.Header[name] = values
+	}
+
+	c.setFreshness(&entry, http.StatusOK, entry.Header)
+
+	return &entry
+}
+
+func (c *Cache) put(key string, vary []string, r *http.Request, entry *cache.Entry) {
+	if len(vary) == 0 {
+		if marker, ok := c.store.Get(key); ok && marker.Vary != nil {
+			// the entry is a variant, its placeholder is kept as is
+			vary = marker.Vary
+		}
+	}
+
+	if len(vary) > 0 {
+		c.store.Put(key, &cache.Entry{
+			Date:       entry.Date,
+			FreshUntil: entry.FreshUntil,
+			StaleUntil: entry.StaleUntil,
+			Vary:       vary,
+		})
+		key = variantKey(key, vary, r)
+	}
+
+	c.store.Put(key, entry)
+}
+
+// setFreshness sets when entry becomes stale, and until when it
+// can be served while it is revalidated
+func (c *Cache) setFreshness(entry *cache.Entry, statusCode int, header http.Header) bool {
+	now := time.Now()
+	control := cache.ParseControl(header.Values("Cache-Control"))
+
+	var age time.Duration
+	if seconds, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+
+	entry.Date = now.Add(-age)
+
+	lifetime, ok := control.Duration("s-maxage")
+	if !ok {
+		lifetime, ok = control.Duration("max-age")
+	}
+	if !ok {
+		if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			lifetime, ok = expires.Sub(date), true
+		} else if header.Get("Expires") != "" {
+			// an invalid Expires means the response is already expired
+			lifetime, ok = 0, true
+		}
+	}
+	if !ok {
+		lifetime = c.DefaultTTL.Duration
+	}
+	if control.Has("no-cache") {
+		lifetime = 0
+	}
+
+	entry.FreshUntil = entry.Date.Add(lifetime)
+
+	swr, ok := control.Duration("stale-while-revalidate")
+	if !ok {
+		swr = c.StaleWhileRevalidate.Duration
+	}
+	if control.Has("must-revalidate") || control.Has("proxy-revalidate") || control.Has("no-cache") {
+		swr = 0
+	}
+
+	entry.StaleUntil = entry.FreshUntil.Add(swr)
+
+	// the age is computed when the entry is served
+	header.Del("Age")
+
+	return cacheableStatusCodes[statusCode] &&
+		!control.Has("no-store") &&
+		!control.Has("private") &&
+		(lifetime > 0 || entry.HasValidators())
+}
+
+// newEntry creates an entry from the captured response, if it can be stored
+func (c *Cache) newEntry(cw *cacheWriter) (*cache.Entry, []string, bool) {
+	if !cw.complete() {
+		return nil, nil, false
+	}
+
+	header := cw.header.Clone()
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	// responses which set cookies are specific to a client
+	if header.Get("Set-Cookie") != "" {
+		return nil, nil, false
+	}
+
+	var vary []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, nil, false
+			}
+			if name != "" {
+				vary = append(vary, name)
+			}
+		}
+	}
+	sort.Strings(vary)
+
+	entry := &cache.Entry{
+		StatusCode: cw.statusCode,
+		Header:     header,
+		Body:       cw.body,
+	}
+
+	if !c.setFreshness(entry, cw.statusCode, header) {
+		return nil, nil, false
+	}
+
+	return entry, vary, true
+}
+
+// cacheWriter sends the response to the client and keeps a copy of it, up to
+// maxBytes. If the request revalidates a stored response, a 304 Not Modified
+// is not sent, so the stored response can be served instead.
+type cacheWriter struct {
+	w            http.ResponseWriter
+	header       http.Header
+	maxBytes     int64
+	revalidating bool
+	statusCode   int
+	body         []byte
+	tooLarge     bool
+	hijacked     bool
+	notModified  bool
+}
+
+var _ http.ResponseWriter = (*cacheWriter)(nil)
+var _ http.Flusher = (*cacheWriter)(nil)
+var _ http.Hijacker = (*cacheWriter)(nil)
+
+func newCacheWriter(w http.ResponseWriter, maxBytes int64, revalidating bool) *cacheWriter {
+	return &cacheWriter{
+		w:            w,
+		header:       make(http.Header),
+		maxBytes:     maxBytes,
+		revalidating: revalidating,
+	}
+}
+
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *cacheWriter) WriteHeader(statusCode int) {
+	if cw.statusCode != 0 {
+		return
+	}
+
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		cw.w.WriteHeader(statusCode)
+		return
+	}
+
+	cw.statusCode = statusCode
+
+	if cw.revalidating && statusCode == http.StatusNotModified {
+		cw.notModified = true
+		return
+	}
+
+	header := cw.w.Header()
+	for name, values := range cw.header {
+		header[name] = values
+	}
+	header.Set(CacheStatusHeader, "MISS")
+
+	cw.w.WriteHeader(statusCode)
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.statusCode == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.notModified {
+		return len(b), nil
+	}
+
+	if !cw.tooLarge {
+		if int64(len(cw.body)+len(b)) > cw.maxBytes {
+			cw.tooLarge = true
+			cw.body = nil
+		} else {
+			cw.body = append(cw.body, b...)
+		}
+	}
+
+	return cw.w.Write(b)
+}
+
+func (cw *cacheWriter) Flush() {
+	if cw.statusCode == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.notModified {
+		return
+	}
+
+	http.NewResponseController(cw.w).Flush()
+}
+
+func (cw *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.hijacked = true
+	return http.NewResponseController(cw.w).Hijack()
+}
+
+func (cw *cacheWriter) Unwrap() http.ResponseWriter {
+	return cw.w
+}
+
+// complete reports whether the whole response was captured
+func (cw *cacheWriter) complete() bool {
+	return cw.statusCode != 0 && !cw.tooLarge && !cw.hijacked && !cw.notModified
+}
+
+func NewCache(maxSize int64, defaultTTL time.Duration, staleWhileRevalidate time.Duration) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: CacheName,
+		Args: &Cache{
+			MaxSize:              maxSize,
+			DefaultTTL:           Duration{Duration: defaultTTL},
+			StaleWhileRevalidate: Duration{Duration: staleWhileRevalidate},
+		},
+	}
+}
+
+func RegisterCache() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[CacheName] = func(raw json.RawMessage) (Middleware, error) {
+			c := &Cache{}
+			err := json.Unmarshal(raw, c)
+			if err != nil {
+				return nil, err
+			}
+
+			if c.MaxSize <= 0 {
+				c.MaxSize = defaultCacheMaxSize
+			}
+			if c.MaxEntrySize <= 0 {
+				c.MaxEntrySize = defaultCacheMaxEntrySize
+			}
+			if c.MaxDiskSize <= 0 {
+				c.MaxDiskSize = defaultCacheMaxDiskSize
+			}
+
+			return c, nil
+		}
+
+		return nil
+	}
+}
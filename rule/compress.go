@@ -0,0 +1,387 @@
+package rule
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+const CompressName = "Compress"
+
+const (
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+const defaultCompressMinSize = 1024
+
+var defaultEncodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+var defaultCompressContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/wasm",
+	"image/svg+xml",
+	"font/",
+}
+
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoders are pooled, as creating them, especially zstd and brotli, allocates a lot
+var encoders = map[string]*sync.Pool{
+	EncodingZstd: {
+		New: func() any {
+			enc, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+			return enc
+		},
+	},
+	EncodingBrotli: {
+		New: func() any {
+			return brotli.NewWriterLevel(nil, 4)
+		},
+	},
+	EncodingGzip: {
+		New: func() any {
+			enc, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+			return enc
+		},
+	},
+}
+
+// Compress compresses the upstream responses using the first of Encodings, which
+// are zstd, br and gzip by default, accepted by the client. Only responses whose
+// Content-Type starts with one of ContentTypes and which are at least MinSize bytes
+// are compressed. Responses which are already encoded and range requests are left
+// untouched. Responses are streamed, only the first MinSize bytes are buffered.
+type Compress struct {
+	Encodings    []string `json:"encodings"`
+	ContentTypes []string `json:"content_types"`
+	MinSize      int      `json:"min_size"`
+}
+
+var _ Middleware = (*Compress)(nil)
+
+func (c *Compress) IsCachable() bool {
+	return false
+}
+
+func (c *Compress) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+// negotiate returns the preferred encoding accepted by the client, or an
+// empty string if none of them are accepted
+func (c *Compress) negotiate(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		accepted[name] = q
+	}
+
+	for _, encoding := range c.Encodings {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > 0 {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+func (c *Compress) isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, prefix := range c.ContentTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Compress) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := c.negotiate(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			compress:       c,
+			encoding:       encoding,
+		}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the beginning of the response until it knows
+// whether it is worth compressing, then streams it through the encoder
+type compressWriter struct {
+	http.ResponseWriter
+	compress    *Compress
+	encoding    string
+	statusCode  int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	enc         encoder
+	hijacked    bool
+}
+
+var _ http.ResponseWriter = (*compressWriter)(nil)
+var _ http.Flusher = (*compressWriter)(nil)
+var _ http.Hijacker = (*compressWriter)(nil)
+
+func (cw *compressWriter) WriteHeader(statusCode int) {
+	if cw.wroteHeader {
+		return
+	}
+
+	// informational responses are sent as is
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		cw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	cw.wroteHeader = true
+	cw.statusCode = statusCode
+
+	if !cw.canCompress() {
+		cw.start(false)
+		return
+	}
+
+	header := cw.Header()
+	header.Add("Vary", "Accept-Encoding")
+
+	if contentLength := header.Get("Content-Length"); contentLength != "" {
+		size, err := strconv.Atoi(contentLength)
+		cw.start(err == nil && size >= cw.compress.MinSize)
+	}
+}
+
+// canCompress checks the parts of the response which are known
+// once the header is written
+func (cw *compressWriter) canCompress() bool {
+	switch cw.statusCode {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent, http.StatusSwitchingProtocols:
+		return false
+	}
+
+	header := cw.Header()
+
+	if encoding := header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+
+	if header.Get("Content-Range") != "" {
+		return false
+	}
+
+	return cw.compress.isCompressible(header.Get("Content-Type"))
+}
+
+// start writes the header, and the buffered body, either through
+// a new encoder or as is
+func (cw *compressWriter) start(compress bool) error {
+	cw.decided = true
+
+	if compress {
+		header := cw.Header()
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", cw.encoding)
+
+		// the compressed body is not byte for byte the same
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+
+		cw.enc = encoders[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.statusCode)
+
+	buf := cw.buf
+	cw.buf = nil
+
+	if len(buf) == 0 {
+		return nil
+	}
+
+	_, err := cw.write(buf)
+	return err
+}
+
+func (cw *compressWriter) write(b []byte) (int, error) {
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if cw.decided {
+		return cw.write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) >= cw.compress.MinSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// Flush sends whatever is buffered, so streamed responses, e.g. server-sent
+// events, are compressed without waiting for MinSize bytes
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.decided {
+		cw.start(cw.canCompress())
+	}
+
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	cw.hijacked = true
+	return http.NewResponseController(cw.ResponseWriter).Hijack()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close is called once the handler returns, a response which is smaller
+// than MinSize is sent as is
+func (cw *compressWriter) close() {
+	if cw.hijacked || !cw.wroteHeader {
+		return
+	}
+
+	if !cw.decided {
+		cw.start(false)
+	}
+
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.enc.Reset(nil)
+		encoders[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+func NewCompress(encodings []string, contentTypes []string, minSize int) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: CompressName,
+		Args: Compress{
+			Encodings:    encodings,
+			ContentTypes: contentTypes,
+			MinSize:      minSize,
+		},
+	}
+}
+
+func RegisterCompress() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[CompressName] = func(raw json.RawMessage) (Middleware, error) {
+			compress := &Compress{}
+			err := json.Unmarshal(raw, compress)
+			if err != nil {
+				return nil, err
+			}
+
+			if len(compress.Encodings) == 0 {
+				compress.Encodings = defaultEncodings
+			}
+			for _, encoding := range compress.Encodings {
+				if _, ok := encoders[encoding]; !ok {
+					return nil, fmt.Errorf("unsupported encoding %q", encoding)
+				}
+			}
+
+			if len(compress.ContentTypes) == 0 {
+				compress.ContentTypes = defaultCompressContentTypes
+			}
+
+			if compress.MinSize <= 0 {
+				compress.MinSize = defaultCompressMinSize
+			}
+
+			return compress, nil
+		}
+
+		return nil
+	}
+}
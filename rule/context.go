@@ -0,0 +1,153 @@
+package rule
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/alinz/baker.go/rule/internal/realip"
+)
+
+type contextKey int
+
+const (
+	paramsKey contextKey = iota
+	routerKey
+	requestInfoKey
+	errorRendererKey
+	mirroredKey
+)
+
+// RequestInfo describes how baker routed a request
+type RequestInfo struct {
+	RequestID   string
+	Domain      string
+	Path        string
+	ContainerID string
+	// Maintenance is set if the domain is put in maintenance using the admin API
+	Maintenance bool
+	// Upgrade is the protocol requested by an upgrade request, e.g. websocket
+	Upgrade string
+}
+
+// WithRequestInfo stores how the request is routed, so rules can reference it
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// GetRequestInfo returns how the request is routed, it never returns nil
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	if info, ok := ctx.Value(requestInfoKey).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
+
+// WithParams stores the path parameters captured by the router so rules
+// can reference them in their arguments, e.g. `/v2/users/{id}`
+func WithParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, paramsKey, params)
+}
+
+// Params returns the path parameters captured by the router
+func Params(ctx context.Context) map[string]string {
+	if params, ok := ctx.Value(paramsKey).(map[string]string); ok {
+		return params
+	}
+	return nil
+}
+
+// WithRouter stores the handler which routes requests to the registered
+// domains, so rules can send requests to other domains and paths
+func WithRouter(ctx context.Context, router http.Handler) context.Context {
+	return context.WithValue(ctx, routerKey, router)
+}
+
+// Router returns the handler which routes requests to the registered domains
+func Router(ctx context.Context) http.Handler {
+	if router, ok := ctx.Value(routerKey).(http.Handler); ok {
+		return router
+	}
+	return nil
+}
+
+// withMirrored marks the shadow requests of Mirror
+func withMirrored(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mirroredKey, true)
+}
+
+// IsMirrored reports whether the request is a shadow request sent by Mirror,
+// MirrorHeader sent by clients is ignored
+func IsMirrored(ctx context.Context) bool {
+	mirrored, _ := ctx.Value(mirroredKey).(bool)
+	return mirrored
+}
+
+// expand replaces every `{name}` in tmpl with the value returned by lookup.
+// Unknown names are kept as they are.
+func expand(tmpl string, lookup func(name string) (string, bool)) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+
+	var sb strings.Builder
+
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start == -1 {
+			break
+		}
+
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end == -1 {
+			break
+		}
+		end += start
+
+		sb.WriteString(tmpl[:start])
+		if value, ok := lookup(tmpl[start+1 : end]); ok {
+			sb.WriteString(value)
+		} else {
+			sb.WriteString(tmpl[start : end+1])
+		}
+
+		tmpl = tmpl[end+1:]
+	}
+
+	sb.WriteString(tmpl)
+
+	return sb.String()
+}
+
+// expandRequest works like expandParams but also resolves client_ip,
+// domain, path, container_id and request_id
+func expandRequest(tmpl string, r *http.Request) string {
+	params := Params(r.Context())
+	info := GetRequestInfo(r.Context())
+
+	return expand(tmpl, func(name string) (string, bool) {
+		switch name {
+		case "client_ip":
+			return realip.RemoteIP(r), true
+		case "domain":
+			return info.Domain, true
+		case "path":
+			return info.Path, true
+		case "container_id":
+			return info.ContainerID, true
+		case "request_id":
+			return info.RequestID, true
+		}
+
+		value, ok := params[name]
+		return value, ok
+	})
+}
+
+func expandParams(tmpl string, ctx context.Context) string {
+	params := Params(ctx)
+	return expand(tmpl, func(name string) (string, bool) {
+		value, ok := params[name]
+		return value, ok
+	})
+}
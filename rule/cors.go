@@ -0,0 +1,211 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const CORSName = "CORS"
+
+var defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodHead}
+
+// CORS answers preflight requests directly and adds the CORS headers to the
+// responses of allowed origins. AllowedOrigins can contain exact origins, `*` or
+// wildcards such as `https://*.example.com`, AllowedOriginRegexes are matched
+// against the whole origin. If AllowedHeaders contains `*`, the headers requested
+// by the preflight request are allowed. AllowCredentials requires the origins
+// to be listed, `*` is rejected then.
+type CORS struct {
+	AllowedOrigins       []string `json:"allowed_origins"`
+	AllowedOriginRegexes []string `json:"allowed_origin_regexes"`
+	AllowedMethods       []string `json:"allowed_methods"`
+	AllowedHeaders       []string `json:"allowed_headers"`
+	ExposedHeaders       []string `json:"exposed_headers"`
+	AllowCredentials     bool     `json:"allow_credentials"`
+	MaxAge               Duration `json:"max_age"`
+	regexes              []*regexp.Regexp
+}
+
+var _ Middleware = (*CORS)(nil)
+
+func (c *CORS) IsCachable() bool {
+	return false
+}
+
+func (c *CORS) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (c *CORS) isOriginAllowed(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok {
+			if len(origin) > len(prefix)+len(suffix) &&
+				strings.HasPrefix(origin, prefix) &&
+				strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+
+	for _, re := range c.regexes {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *CORS) allowAnyOrigin() bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) setOrigin(header http.Header, origin string) {
+	// `*` is rejected along with credentials, see RegisterCORS
+	if c.allowAnyOrigin() {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Add("Vary", "Origin")
+	}
+
+	if c.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (c *CORS) preflight(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	origin := r.Header.Get("Origin")
+
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	if !c.isOriginAllowed(origin) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	methods := c.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+
+	c.setOrigin(header, origin)
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	for _, allowed := range c.AllowedHeaders {
+		if allowed == "*" {
+			if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+				header.Set("Access-Control-Allow-Headers", requested)
+			}
+			break
+		}
+		header.Add("Access-Control-Allow-Headers", allowed)
+	}
+
+	if c.MaxAge.Duration > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *CORS) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.preflight(w, r)
+			return
+		}
+
+		if !c.isOriginAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&hookWriter{
+			ResponseWriter: w,
+			beforeWriteHeader: func(statusCode int) {
+				header := w.Header()
+
+				// the headers set by the container are replaced
+				// to avoid sending conflicting values
+				header.Del("Access-Control-Allow-Origin")
+				header.Del("Access-Control-Allow-Credentials")
+				header.Del("Access-Control-Expose-Headers")
+
+				c.setOrigin(header, origin)
+				if len(c.ExposedHeaders) > 0 {
+					header.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+				}
+			},
+		}, r)
+	})
+}
+
+func NewCORS(allowedOrigins []string, allowedMethods []string, allowedHeaders []string, allowCredentials bool) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: CORSName,
+		Args: CORS{
+			AllowedOrigins:   allowedOrigins,
+			AllowedMethods:   allowedMethods,
+			AllowedHeaders:   allowedHeaders,
+			AllowCredentials: allowCredentials,
+		},
+	}
+}
+
+func RegisterCORS() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[CORSName] = func(raw json.RawMessage) (Middleware, error) {
+			cors := &CORS{}
+			err := json.Unmarshal(raw, cors)
+			if err != nil {
+				return nil, err
+			}
+
+			// browsers refuse credentials for `*`, reflecting every
+			// origin instead would let any site read the responses
+			if cors.AllowCredentials && cors.allowAnyOrigin() {
+				return nil, fmt.Errorf("allowed_origins can't contain * when allow_credentials is set")
+			}
+
+			for _, expr := range cors.AllowedOriginRegexes {
+				re, err := compileRegexp("^(?:" + expr + ")$")
+				if err != nil {
+					return nil, err
+				}
+				cors.regexes = append(cors.regexes, re)
+			}
+
+			return cors, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,32 @@
+package rule
+
+import (
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration encoded as a string in JSON, e.g. "60s"
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON implements the json.Marshaler interface for Duration.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%s"`, d.String())), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface for Duration.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if len(data) < 2 {
+		d.Duration = 0
+		return nil
+	}
+
+	duration, err := time.ParseDuration(string(data[1 : len(data)-1]))
+	if err != nil {
+		return err
+	}
+
+	d.Duration = duration
+	return nil
+}
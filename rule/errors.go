@@ -0,0 +1,457 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+)
+
+const ErrorPagesName = "ErrorPages"
+
+// ErrorRenderer writes the error responses generated by baker and its rules
+type ErrorRenderer interface {
+	RenderError(w http.ResponseWriter, r *http.Request, statusCode int, message string)
+}
+
+// ErrorData is passed to the error templates
+type ErrorData struct {
+	StatusCode int
+	Status     string
+	Message    string
+	RequestID  string
+	Domain     string
+	Path       string
+}
+
+func newErrorData(r *http.Request, statusCode int, message string) ErrorData {
+	return ErrorData{
+		StatusCode: statusCode,
+		Status:     http.StatusText(statusCode),
+		Message:    message,
+		RequestID:  GetRequestInfo(r.Context()).RequestID,
+		Domain:     r.Host,
+		Path:       r.URL.Path,
+	}
+}
+
+// WithErrorRenderer sets the renderer used by Error for the request
+func WithErrorRenderer(ctx context.Context, renderer ErrorRenderer) context.Context {
+	return context.WithValue(ctx, errorRendererKey, renderer)
+}
+
+func getErrorRenderer(ctx context.Context) ErrorRenderer {
+	if renderer, ok := ctx.Value(errorRendererKey).(ErrorRenderer); ok {
+		return renderer
+	}
+	return DefaultErrorRenderer
+}
+
+// Error writes an error response using the renderer of the request, every
+// response generated by baker or its rules should go through it. gRPC requests
+// receive the matching grpc-status instead.
+func Error(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	// the error is generated by baker, it must not be replaced
+	// as if it was sent by the container
+	for current := w; current != nil; {
+		if iw, ok := current.(*interceptWriter); ok {
+			iw.bypass = true
+			break
+		}
+
+		unwrapper, ok := current.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		current = unwrapper.Unwrap()
+	}
+
+	// gRPC clients can't read error pages
+	if IsGRPC(r) {
+		writeGRPCError(w, statusCode, message)
+		return
+	}
+
+	getErrorRenderer(r.Context()).RenderError(w, r, statusCode, message)
+}
+
+// wantsHTML reports whether the client is a browser, every other
+// client receives JSON
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func writeError(w http.ResponseWriter, statusCode int, contentType string, body []byte) {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+	header.Set("Cache-Control", "no-store")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
+
+var defaultHTMLTemplate = htmltemplate.Must(htmltemplate.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.StatusCode}} {{.Status}}</title></head>
+<body>
+<h1>{{.StatusCode}} {{.Status}}</h1>
+<p>{{.Message}}</p>
+<p><small>Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`))
+
+type defaultErrorRenderer struct{}
+
+// DefaultErrorRenderer renders errors as `{"error": "...", "request_id": "..."}`,
+// or as a simple HTML page for browsers
+var DefaultErrorRenderer ErrorRenderer = defaultErrorRenderer{}
+
+func (defaultErrorRenderer) RenderError(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	data := newErrorData(r, statusCode, message)
+
+	if wantsHTML(r) {
+		var buf bytes.Buffer
+		defaultHTMLTemplate.Execute(&buf, data)
+		writeError(w, statusCode, "text/html; charset=utf-8", buf.Bytes())
+		return
+	}
+
+	body, _ := json.Marshal(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}{
+		Error:     message,
+		RequestID: data.RequestID,
+	})
+
+	writeError(w, statusCode, "application/json", body)
+}
+
+// templateSource is a template given inline, or loaded from a file
+// which is reloaded once it is modified
+type templateSource struct {
+	inline  string
+	file    string
+	text    string
+	modTime time.Time
+	loaded  bool
+	failed  bool
+}
+
+// reload reports whether the text of the template is changed, if the file
+// can't be read, the previous text is kept and the error is only logged once
+func (t *templateSource) reload() bool {
+	if t.file == "" {
+		changed := !t.loaded || t.text != t.inline
+		t.text = t.inline
+		t.loaded = true
+		return changed
+	}
+
+	info, err := os.Stat(t.file)
+	if err == nil && t.loaded && info.ModTime().Equal(t.modTime) {
+		return false
+	}
+
+	var data []byte
+	if err == nil {
+		data, err = os.ReadFile(t.file)
+	}
+	if err != nil {
+		if !t.failed {
+			log.Error().Err(err).Str("type", ErrorPagesName).Str("path", t.file).Msg("failed to load template")
+		}
+		t.failed = true
+		return false
+	}
+
+	t.text = string(data)
+	t.modTime = info.ModTime()
+	t.loaded = true
+	t.failed = false
+
+	return true
+}
+
+// ErrorPages renders the errors of a domain using its own templates, HTML for
+// browsers and JSON for every other client. Templates are given inline or loaded
+// from a file, and receive the StatusCode, Status, Message, RequestID, Domain and
+// Path of the error. The JSON template can use `json` to quote a value. If
+// InterceptUpstream is set, the responses of the container whose status code is
+// one of InterceptStatusCodes, any 5xx by default, are replaced by the error page.
+type ErrorPages struct {
+	HTML                 string `json:"html"`
+	HTMLFile             string `json:"html_file"`
+	JSON                 string `json:"json"`
+	JSONFile             string `json:"json_file"`
+	InterceptUpstream    bool   `json:"intercept_upstream"`
+	InterceptStatusCodes []int  `json:"intercept_status_codes"`
+	htmlSource           templateSource
+	jsonSource           templateSource
+	htmlTemplate         *htmltemplate.Template
+	jsonTemplate         *texttemplate.Template
+	mu                   sync.RWMutex
+}
+
+var _ Middleware = (*ErrorPages)(nil)
+var _ ErrorRenderer = (*ErrorPages)(nil)
+var _ Reloader = (*ErrorPages)(nil)
+
+// ErrorPages is cachable, so the templates are parsed once, and only
+// reloaded periodically, see Reloader
+func (e *ErrorPages) IsCachable() bool {
+	return true
+}
+
+func (e *ErrorPages) UpdateMiddelware(newImpl Middleware) Middleware {
+	if newImpl == nil {
+		e.Load()
+		return e
+	}
+
+	newE, ok := newImpl.(*ErrorPages)
+	if !ok {
+		log.Error().
+			Str("type", ErrorPagesName).
+			Msg("failed to update middleware")
+		return e
+	}
+
+	if argsKey(e) == argsKey(newE) {
+		return e
+	}
+
+	newE.Load()
+	return newE
+}
+
+var jsonFuncs = texttemplate.FuncMap{
+	"json": func(v any) string {
+		b, _ := json.Marshal(v)
+		return string(b)
+	},
+}
+
+// Load parses the templates, the files are only read again once they are modified.
+// If a template is invalid, the default one is used.
+func (e *ErrorPages) Load() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.htmlSource.inline, e.htmlSource.file = e.HTML, e.HTMLFile
+	e.jsonSource.inline, e.jsonSource.file = e.JSON, e.JSONFile
+
+	if e.htmlSource.reload() {
+		e.htmlTemplate = nil
+		if e.htmlSource.text != "" {
+			tmpl, err := htmltemplate.New("error").Parse(e.htmlSource.text)
+			if err != nil {
+				log.Error().Err(err).Str("type", ErrorPagesName).Msg("failed to parse html template")
+			}
+			e.htmlTemplate = tmpl
+		}
+	}
+
+	if e.jsonSource.reload() {
+		e.jsonTemplate = nil
+		if e.jsonSource.text != "" {
+			tmpl, err := texttemplate.New("error").Funcs(jsonFuncs).Parse(e.jsonSource.text)
+			if err != nil {
+				log.Error().Err(err).Str("type", ErrorPagesName).Msg("failed to parse json template")
+			}
+			e.jsonTemplate = tmpl
+		}
+	}
+}
+
+func (e *ErrorPages) Reload() {
+	e.Load()
+}
+
+func (e *ErrorPages) RenderError(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	e.mu.RLock()
+	htmlTemplate, jsonTemplate := e.htmlTemplate, e.jsonTemplate
+	e.mu.RUnlock()
+
+	data := newErrorData(r, statusCode, message)
+
+	var buf bytes.Buffer
+
+	if wantsHTML(r) && htmlTemplate != nil {
+		if err := htmlTemplate.Execute(&buf, data); err == nil {
+			writeError(w, statusCode, "text/html; charset=utf-8", buf.Bytes())
+			return
+		}
+	} else if !wantsHTML(r) && jsonTemplate != nil {
+		if err := jsonTemplate.Execute(&buf, data); err == nil {
+			writeError(w, statusCode, "application/json", buf.Bytes())
+			return
+		}
+	}
+
+	DefaultErrorRenderer.RenderError(w, r, statusCode, message)
+}
+
+func (e *ErrorPages) intercepts(statusCode int) bool {
+	if !e.InterceptUpstream {
+		return false
+	}
+
+	if len(e.InterceptStatusCodes) == 0 {
+		return statusCode >= 500 && statusCode < 600
+	}
+
+	for _, code := range e.InterceptStatusCodes {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (e *ErrorPages) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(WithErrorRenderer(r.Context(), e))
+
+		if !e.InterceptUpstream || IsGRPC(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&interceptWriter{ResponseWriter: w, r: r, pages: e}, r)
+	})
+}
+
+// interceptWriter replaces the responses of the container whose status
+// code is intercepted by the error page
+type interceptWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	pages       *ErrorPages
+	wroteHeader bool
+	intercepted bool
+	bypass      bool
+}
+
+var _ http.ResponseWriter = (*interceptWriter)(nil)
+var _ http.Flusher = (*interceptWriter)(nil)
+var _ http.Hijacker = (*interceptWriter)(nil)
+
+// upstreamHeaders describe the body of the container, which is replaced
+var upstreamHeaders = []string{
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-Disposition",
+	"Content-Range",
+	"ETag",
+	"Last-Modified",
+	"Expires",
+}
+
+func (iw *interceptWriter) WriteHeader(statusCode int) {
+	if iw.wroteHeader {
+		return
+	}
+
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		iw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	iw.wroteHeader = true
+
+	if iw.bypass || !iw.pages.intercepts(statusCode) {
+		iw.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+
+	iw.intercepted = true
+
+	for _, name := range upstreamHeaders {
+		iw.Header().Del(name)
+	}
+
+	iw.pages.RenderError(iw.ResponseWriter, iw.r, statusCode, strings.ToLower(http.StatusText(statusCode)))
+}
+
+func (iw *interceptWriter) Write(b []byte) (int, error) {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+
+	if iw.intercepted {
+		return len(b), nil
+	}
+
+	return iw.ResponseWriter.Write(b)
+}
+
+func (iw *interceptWriter) Flush() {
+	if iw.intercepted {
+		return
+	}
+
+	http.NewResponseController(iw.ResponseWriter).Flush()
+}
+
+func (iw *interceptWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(iw.ResponseWriter).Hijack()
+}
+
+func (iw *interceptWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+func NewErrorPages(html string, json string, interceptUpstream bool) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: ErrorPagesName,
+		Args: &ErrorPages{
+			HTML:              html,
+			JSON:              json,
+			InterceptUpstream: interceptUpstream,
+		},
+	}
+}
+
+func RegisterErrorPages() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[ErrorPagesName] = func(raw json.RawMessage) (Middleware, error) {
+			errorPages := &ErrorPages{}
+			err := json.Unmarshal(raw, errorPages)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, code := range errorPages.InterceptStatusCodes {
+				if code < 400 || code > 599 {
+					return nil, fmt.Errorf("invalid intercept status code %d", code)
+				}
+			}
+
+			return errorPages, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,210 @@
+package rule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+	"github.com/alinz/baker.go/rule/internal/realip"
+)
+
+const ForwardAuthName = "ForwardAuth"
+
+const (
+	defaultForwardAuthTimeout = 5 * time.Second
+	// maxForwardAuthBodyBytes limits the body of the auth response
+	// which is sent back to the client
+	maxForwardAuthBodyBytes = 1 << 20
+)
+
+var forwardAuthClient = &http.Client{
+	// redirects, e.g. to a login page, are sent back to the client
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// forwardAuthKey marks subrequests, so an auth service routed by baker
+// can't trigger another subrequest to itself
+type forwardAuthKey struct{}
+
+// ForwardAuth asks an auth service whether a request is allowed before it is sent
+// to the container. The auth service is either a domain registered in baker or
+// a fixed URL. If it answers with 2xx, the ResponseHeaders are copied onto the
+// request, otherwise its response is sent back to the client. RequestHeaders
+// selects which headers are sent to the auth service, all of them by default.
+type ForwardAuth struct {
+	URL             string   `json:"url"`
+	Domain          string   `json:"domain"`
+	Path            string   `json:"path"`
+	Method          string   `json:"method"`
+	RequestHeaders  []string `json:"request_headers"`
+	ResponseHeaders []string `json:"response_headers"`
+	Timeout         Duration `json:"timeout"`
+}
+
+var _ Middleware = (*ForwardAuth)(nil)
+
+func (f *ForwardAuth) IsCachable() bool {
+	return false
+}
+
+func (f *ForwardAuth) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (f *ForwardAuth) subrequest(ctx context.Context, r *http.Request) (*http.Request, error) {
+	method := f.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	target := f.URL
+	if target == "" {
+		target = (&url.URL{Scheme: "http", Host: f.Domain, Path: f.Path}).String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(f.RequestHeaders) == 0 {
+		req.Header = r.Header.Clone()
+	} else {
+		for _, name := range f.RequestHeaders {
+			for _, value := range r.Header.Values(name) {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", realip.RemoteIP(r))
+	req.RemoteAddr = r.RemoteAddr
+
+	return req, nil
+}
+
+func (f *ForwardAuth) send(req *http.Request, router http.Handler) (*http.Response, error) {
+	if f.URL != "" {
+		return forwardAuthClient.Do(req)
+	}
+
+	if router == nil {
+		return nil, fmt.Errorf("no router is available")
+	}
+
+	w := newBufferWriter(maxForwardAuthBodyBytes)
+	router.ServeHTTP(w, req)
+
+	return w.result(), nil
+}
+
+func (f *ForwardAuth) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(forwardAuthKey{}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		timeout := f.Timeout.Duration
+		if timeout <= 0 {
+			timeout = defaultForwardAuthTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		req, err := f.subrequest(context.WithValue(ctx, forwardAuthKey{}, true), r)
+		if err == nil {
+			var resp *http.Response
+			resp, err = f.send(req, Router(r.Context()))
+			if err == nil {
+				defer resp.Body.Close()
+				f.handle(w, r, resp, next)
+				return
+			}
+		}
+
+		log.Error().
+			Err(err).
+			Str("type", ForwardAuthName).
+			Msg("failed to reach auth service")
+		Error(w, r, http.StatusBadGateway, "failed to reach the auth service")
+	})
+}
+
+func (f *ForwardAuth) handle(w http.ResponseWriter, r *http.Request, resp *http.Response, next http.Handler) {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		for _, name := range f.ResponseHeaders {
+			r.Header.Del(name)
+			for _, value := range resp.Header.Values(name) {
+				r.Header.Add(name, value)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	for name, values := range resp.Header {
+		if name == "Content-Length" || name == "Transfer-Encoding" {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, io.LimitReader(resp.Body, maxForwardAuthBodyBytes))
+}
+
+func NewForwardAuth(authURL string, domain string, path string, responseHeaders []string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: ForwardAuthName,
+		Args: ForwardAuth{
+			URL:             authURL,
+			Domain:          domain,
+			Path:            path,
+			ResponseHeaders: responseHeaders,
+		},
+	}
+}
+
+func RegisterForwardAuth() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[ForwardAuthName] = func(raw json.RawMessage) (Middleware, error) {
+			forwardAuth := &ForwardAuth{}
+			err := json.Unmarshal(raw, forwardAuth)
+			if err != nil {
+				return nil, err
+			}
+			if forwardAuth.URL == "" && forwardAuth.Domain == "" {
+				return nil, fmt.Errorf("either url or domain is required")
+			}
+			return forwardAuth, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,113 @@
+package rule
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+const HeadersName = "Headers"
+
+// HeaderOps modifies a header. Operations are applied in the following order,
+// rename, remove, set and add. Values can reference {client_ip}, {domain}, {path},
+// {container_id}, {request_id} and the path parameters.
+type HeaderOps struct {
+	Set    map[string]string `json:"set"`
+	Add    map[string]string `json:"add"`
+	Remove []string          `json:"remove"`
+	Rename map[string]string `json:"rename"`
+}
+
+func (o *HeaderOps) isEmpty() bool {
+	return len(o.Set) == 0 && len(o.Add) == 0 && len(o.Remove) == 0 && len(o.Rename) == 0
+}
+
+func (o *HeaderOps) apply(header http.Header, r *http.Request) {
+	for from, to := range o.Rename {
+		values := header.Values(from)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(from)
+		for _, value := range values {
+			header.Add(to, value)
+		}
+	}
+
+	for _, name := range o.Remove {
+		header.Del(name)
+	}
+
+	for name, value := range o.Set {
+		header.Set(name, expandRequest(value, r))
+	}
+
+	for name, value := range o.Add {
+		header.Add(name, expandRequest(value, r))
+	}
+}
+
+// Headers modifies the request header before it is sent to the container
+// and the response header before it is sent back to the client
+type Headers struct {
+	Request  HeaderOps `json:"request"`
+	Response HeaderOps `json:"response"`
+}
+
+var _ Middleware = (*Headers)(nil)
+
+func (h *Headers) IsCachable() bool {
+	return false
+}
+
+func (h *Headers) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (h *Headers) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.Request.apply(r.Header, r)
+
+		if h.Response.isEmpty() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(&hookWriter{
+			ResponseWriter: w,
+			beforeWriteHeader: func(statusCode int) {
+				h.Response.apply(w.Header(), r)
+			},
+		}, r)
+	})
+}
+
+func NewHeaders(request HeaderOps, response HeaderOps) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: HeadersName,
+		Args: Headers{
+			Request:  request,
+			Response: response,
+		},
+	}
+}
+
+func RegisterHeaders() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[HeadersName] = func(raw json.RawMessage) (Middleware, error) {
+			headers := &Headers{}
+			err := json.Unmarshal(raw, headers)
+			if err != nil {
+				return nil, err
+			}
+			return headers, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Control holds the directives of a Cache-Control header
+type Control map[string]string
+
+// ParseControl parses the values of one or more Cache-Control headers
+func ParseControl(values []string) Control {
+	control := make(Control)
+
+	for _, value := range values {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			control[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+
+	return control
+}
+
+func (c Control) Has(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// Duration returns the value of a directive given in seconds, such as max-age
+func (c Control) Duration(name string) (time.Duration, bool) {
+	value, ok := c[name]
+	if !ok {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+// Entry is a stored response. An entry with Vary set is a placeholder, which
+// lists the request headers used to select the stored variant of the response.
+type Entry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Date is when the response was generated by the upstream
+	Date time.Time
+	// FreshUntil is when the entry becomes stale
+	FreshUntil time.Time
+	// StaleUntil is the end of the stale-while-revalidate window
+	StaleUntil time.Time
+	Vary       []string
+}
+
+func (e *Entry) size(key string) int64 {
+	size := int64(len(key) + len(e.Body) + 64)
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	for _, name := range e.Vary {
+		size += int64(len(name))
+	}
+	return size
+}
+
+func (e *Entry) IsFresh(now time.Time) bool {
+	return now.Before(e.FreshUntil)
+}
+
+// CanServeStale reports whether the entry can be served
+// while it is revalidated in the background
+func (e *Entry) CanServeStale(now time.Time) bool {
+	return now.Before(e.StaleUntil)
+}
+
+// HasValidators reports whether the entry can be revalidated
+// using a conditional request
+func (e *Entry) HasValidators() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// Age returns how long ago the response was generated
+func (e *Entry) Age(now time.Time) time.Duration {
+	age := now.Sub(e.Date)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
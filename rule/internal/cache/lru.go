@@ -0,0 +1,84 @@
+package cache
+
+import "container/list"
+
+type lruItem struct {
+	key   string
+	size  int64
+	value *Entry
+}
+
+// lru keeps items until their total size reaches maxBytes, then the
+// least recently used items are evicted
+type lru struct {
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) get(key string) (*lruItem, bool) {
+	elem, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	l.ll.MoveToFront(elem)
+	return elem.Value.(*lruItem), true
+}
+
+// put adds or replaces an item and returns the keys of the evicted items.
+// An item bigger than maxBytes is not added.
+func (l *lru) put(key string, value *Entry, size int64) []string {
+	l.remove(key)
+
+	if size > l.maxBytes {
+		return nil
+	}
+
+	l.items[key] = l.ll.PushFront(&lruItem{key: key, size: size, value: value})
+	l.size += size
+
+	var evicted []string
+	for l.size > l.maxBytes {
+		oldest := l.ll.Back()
+		item := oldest.Value.(*lruItem)
+		l.remove(item.key)
+		evicted = append(evicted, item.key)
+	}
+
+	return evicted
+}
+
+func (l *lru) remove(key string) bool {
+	elem, ok := l.items[key]
+	if !ok {
+		return false
+	}
+
+	l.ll.Remove(elem)
+	delete(l.items, key)
+	l.size -= elem.Value.(*lruItem).size
+
+	return true
+}
+
+func (l *lru) keys() []string {
+	keys := make([]string, 0, len(l.items))
+	for key := range l.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (l *lru) len() int {
+	return len(l.items)
+}
@@ -0,0 +1,377 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const diskFileExt = ".cache"
+
+// maxPendingWrites bounds the entries waiting to be written to disk, the
+// entries put while the queue is full are only kept in memory
+const maxPendingWrites = 256
+
+// Store keeps entries in memory, and if dir is set, on disk too. Entries are
+// written to both tiers, once an entry is evicted from memory, it is read back
+// from disk on the next access. Entries on disk survive restarts.
+type Store struct {
+	mu     sync.Mutex
+	memory *lru
+
+	dir    string
+	diskMu sync.Mutex
+	disk   *lru
+
+	// the disk writes are done by a single goroutine, which runs while
+	// queue isn't empty, idle is signaled once it is done
+	queue   []diskWrite
+	writing bool
+	idle    *sync.Cond
+
+	// purges which happened while writes were queued, a write queued
+	// before a matching purge is dropped
+	generation uint64
+	purges     []purge
+}
+
+type diskWrite struct {
+	key   string
+	entry *Entry
+	gen   uint64
+}
+
+type purge struct {
+	gen   uint64
+	match func(key string) bool
+}
+
+// NewStore creates a store which keeps at most maxBytes in memory and, if dir is
+// not empty, at most maxDiskBytes in dir. Entries already in dir are loaded.
+func NewStore(maxBytes int64, dir string, maxDiskBytes int64) (*Store, error) {
+	s := &Store{
+		memory: newLRU(maxBytes),
+		dir:    dir,
+	}
+	s.idle = sync.NewCond(&s.mu)
+
+	if dir == "" {
+		return s, nil
+	}
+
+	s.disk = newLRU(maxDiskBytes)
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type diskFile struct {
+	key  string
+	size int64
+	mod  int64
+}
+
+// load rebuilds the index of the entries on disk, the least recently modified
+// files are the first to be evicted
+func (s *Store) load() error {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+diskFileExt))
+	if err != nil {
+		return err
+	}
+
+	files := make([]diskFile, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		key, err := readKey(path)
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+
+		files = append(files, diskFile{key: key, size: info.Size(), mod: info.ModTime().UnixNano()})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mod < files[j].mod
+	})
+
+	for _, file := range files {
+		for _, evicted := range s.disk.put(file.key, nil, file.size) {
+			os.Remove(s.path(evicted))
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+diskFileExt)
+}
+
+func readKey(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var key string
+	err = gob.NewDecoder(file).Decode(&key)
+	return key, err
+}
+
+func readEntry(path string, key string) (*Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dec := gob.NewDecoder(file)
+
+	var storedKey string
+	if err := dec.Decode(&storedKey); err != nil {
+		return nil, err
+	}
+	if storedKey != key {
+		return nil, os.ErrNotExist
+	}
+
+	entry := &Entry{}
+	if err := dec.Decode(entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// writeEntry writes the key first, so the index can be rebuilt
+// without decoding whole entries
+func writeEntry(path string, key string, entry *Entry) (int64, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+
+	enc := gob.NewEncoder(file)
+	if err := enc.Encode(key); err != nil {
+		file.Close()
+		return 0, err
+	}
+	if err := enc.Encode(entry); err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, err
+	}
+
+	return info.Size(), os.Rename(file.Name(), path)
+}
+
+// Get returns the entry stored for key, entries must not be modified
+func (s *Store) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	item, ok := s.memory.get(key)
+	s.mu.Unlock()
+
+	if ok {
+		return item.value, true
+	}
+
+	if s.disk == nil {
+		return nil, false
+	}
+
+	s.diskMu.Lock()
+	defer s.diskMu.Unlock()
+
+	if _, ok := s.disk.get(key); !ok {
+		return nil, false
+	}
+
+	entry, err := readEntry(s.path(key), key)
+	if err != nil {
+		s.disk.remove(key)
+		os.Remove(s.path(key))
+		return nil, false
+	}
+
+	s.mu.Lock()
+	s.memory.put(key, entry, entry.size(key))
+	s.mu.Unlock()
+
+	return entry, true
+}
+
+// Put stores the entry in memory, then writes it to disk in the background
+func (s *Store) Put(key string, entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memory.put(key, entry, entry.size(key))
+
+	if s.disk == nil || len(s.queue) >= maxPendingWrites {
+		return
+	}
+
+	s.queue = append(s.queue, diskWrite{key: key, entry: entry, gen: s.generation})
+
+	if !s.writing {
+		s.writing = true
+		go s.writeDisk()
+	}
+}
+
+// writeDisk writes the queued entries until the queue is empty
+func (s *Store) writeDisk() {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.writing = false
+			s.purges = nil
+			s.idle.Broadcast()
+			s.mu.Unlock()
+			return
+		}
+
+		write := s.queue[0]
+		s.queue[0] = diskWrite{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		s.putDisk(write)
+	}
+}
+
+// purged reports whether key was purged after write was queued, the
+// writes left in the queue are newer, so older purges are forgotten
+func (s *Store) purged(write diskWrite) bool {
+	purged := false
+	purges := s.purges[:0]
+	for _, p := range s.purges {
+		if p.gen > write.gen {
+			purged = purged || p.match(write.key)
+			purges = append(purges, p)
+		}
+	}
+	s.purges = purges
+
+	return purged
+}
+
+func (s *Store) putDisk(write diskWrite) {
+	s.diskMu.Lock()
+	defer s.diskMu.Unlock()
+
+	s.mu.Lock()
+	purged := s.purged(write)
+	s.mu.Unlock()
+
+	if purged {
+		return
+	}
+
+	key := write.key
+	path := s.path(key)
+
+	size, err := writeEntry(path, key, write.entry)
+	if err != nil {
+		s.disk.remove(key)
+		os.Remove(path)
+		return
+	}
+
+	if size > s.disk.maxBytes {
+		s.disk.remove(key)
+		os.Remove(path)
+		return
+	}
+
+	for _, evicted := range s.disk.put(key, nil, size) {
+		os.Remove(s.path(evicted))
+	}
+}
+
+func (s *Store) Delete(key string) {
+	s.Purge(func(k string) bool {
+		return k == key
+	})
+}
+
+// Purge removes every entry whose key matches and returns
+// the number of removed entries
+func (s *Store) Purge(match func(key string) bool) int {
+	purged := make(map[string]struct{})
+
+	s.mu.Lock()
+	for _, key := range s.memory.keys() {
+		if match(key) {
+			s.memory.remove(key)
+			purged[key] = struct{}{}
+		}
+	}
+
+	// the queued writes would put the entries back on disk otherwise
+	if s.writing {
+		s.generation++
+		s.purges = append(s.purges, purge{gen: s.generation, match: match})
+	}
+	s.mu.Unlock()
+
+	if s.disk != nil {
+		s.diskMu.Lock()
+		for _, key := range s.disk.keys() {
+			if match(key) {
+				s.disk.remove(key)
+				os.Remove(s.path(key))
+				purged[key] = struct{}{}
+			}
+		}
+		s.diskMu.Unlock()
+	}
+
+	return len(purged)
+}
+
+// Len returns the number of entries kept in memory
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.memory.len()
+}
+
+// Wait waits for the pending disk writes
+func (s *Store) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.writing {
+		s.idle.Wait()
+	}
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEntry(body string) *Entry {
+	return &Entry{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       []byte(body),
+		Date:       time.Now(),
+		FreshUntil: time.Now().Add(time.Minute),
+	}
+}
+
+func TestStoreEviction(t *testing.T) {
+	store, err := NewStore(1024, "", 0)
+	assert.NoError(t, err)
+
+	body := strings.Repeat("a", 300)
+
+	store.Put("a", newEntry(body))
+	store.Put("b", newEntry(body))
+
+	// a is now the most recently used
+	_, ok := store.Get("a")
+	assert.True(t, ok)
+
+	store.Put("c", newEntry(body))
+
+	_, ok = store.Get("b")
+	assert.False(t, ok)
+	_, ok = store.Get("a")
+	assert.True(t, ok)
+	_, ok = store.Get("c")
+	assert.True(t, ok)
+
+	// entries bigger than the store are not kept
+	store.Put("d", newEntry(strings.Repeat("a", 2048)))
+	_, ok = store.Get("d")
+	assert.False(t, ok)
+}
+
+func TestStoreDisk(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewStore(512, dir, 1<<20)
+	assert.NoError(t, err)
+
+	body := strings.Repeat("a", 300)
+
+	store.Put("GET example.com /a", newEntry(body))
+	store.Put("GET example.com /b", newEntry(body))
+	store.Wait()
+
+	// a was evicted from memory, but is still on disk
+	entry, ok := store.Get("GET example.com /a")
+	assert.True(t, ok)
+	assert.Equal(t, body, string(entry.Body))
+	assert.Equal(t, "text/plain", entry.Header.Get("Content-Type"))
+
+	// a new store loads the entries written by the previous one
+	store, err = NewStore(512, dir, 1<<20)
+	assert.NoError(t, err)
+
+	_, ok = store.Get("GET example.com /b")
+	assert.True(t, ok)
+
+	purged := store.Purge(func(key string) bool {
+		return strings.HasPrefix(key, "GET example.com /a")
+	})
+	assert.Equal(t, 1, purged)
+
+	_, ok = store.Get("GET example.com /a")
+	assert.False(t, ok)
+	_, ok = store.Get("GET example.com /b")
+	assert.True(t, ok)
+}
+
+func TestStorePurgePending(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewStore(1<<20, dir, 1<<20)
+	assert.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		store.Put("GET example.com /a", newEntry("a"))
+		store.Put("GET example.com /b", newEntry("b"))
+	}
+
+	// the writes queued before the purge don't put the entries back
+	store.Purge(func(key string) bool {
+		return key == "GET example.com /a"
+	})
+	store.Wait()
+
+	store, err = NewStore(1<<20, dir, 1<<20)
+	assert.NoError(t, err)
+
+	_, ok := store.Get("GET example.com /a")
+	assert.False(t, ok)
+	_, ok = store.Get("GET example.com /b")
+	assert.True(t, ok)
+}
+
+func TestParseControl(t *testing.T) {
+	control := ParseControl([]string{`public, max-age=60`, `stale-while-revalidate="30", No-Cache`})
+
+	assert.True(t, control.Has("public"))
+	assert.True(t, control.Has("no-cache"))
+	assert.False(t, control.Has("private"))
+
+	maxAge, ok := control.Duration("max-age")
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, maxAge)
+
+	swr, ok := control.Duration("stale-while-revalidate")
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, swr)
+
+	_, ok = control.Duration("public")
+	assert.False(t, ok)
+}
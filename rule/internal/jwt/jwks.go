@@ -0,0 +1,157 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+type key struct {
+	kid   string
+	alg   string
+	value any
+}
+
+// KeySet holds the keys used to verify tokens
+type KeySet struct {
+	keys []key
+}
+
+// find returns the key with kid, if kid is empty, the first key
+// which can be used with alg is returned
+func (k *KeySet) find(kid string, alg string) (any, bool) {
+	for _, key := range k.keys {
+		if kid != "" && key.kid != kid {
+			continue
+		}
+		if key.alg != "" && key.alg != alg {
+			continue
+		}
+		if !isKeyType(key.value, alg) {
+			continue
+		}
+		return key.value, true
+	}
+
+	return nil, false
+}
+
+func (k *KeySet) Len() int {
+	return len(k.keys)
+}
+
+func isKeyType(value any, alg string) bool {
+	switch value.(type) {
+	case []byte:
+		return alg == HS256
+	case *rsa.PublicKey:
+		return alg == RS256
+	case *ecdsa.PublicKey:
+		return alg == ES256
+	default:
+		return false
+	}
+}
+
+// NewSecret returns a key set with a single HS256 shared secret
+func NewSecret(secret []byte) *KeySet {
+	return &KeySet{
+		keys: []key{{alg: HS256, value: secret}},
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// ParseJWKS parses a JSON Web Key Set as defined by RFC 7517. Keys
+// which are not used for signatures or have an unknown type are skipped.
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keySet := &KeySet{}
+
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		value, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", jwk.Kid, err)
+		}
+		if value == nil {
+			continue
+		}
+
+		keySet.keys = append(keySet.keys, key{
+			kid:   jwk.Kid,
+			alg:   jwk.Alg,
+			value: value,
+		})
+	}
+
+	return keySet, nil
+}
+
+func (j *jwk) publicKey() (any, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(j.K)
+	default:
+		return nil, nil
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,251 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported algorithm")
+	ErrKeyNotFound      = errors.New("key not found")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrExpired          = errors.New("token is expired")
+	ErrMissingExp       = errors.New("token has no expiration")
+	ErrNotValidYet      = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+)
+
+type Claims map[string]any
+
+// String returns the claim as a string, numbers are formatted
+// without exponent and arrays are joined by comma
+func (c Claims) String(name string) (string, bool) {
+	switch value := c[name].(type) {
+	case string:
+		return value, true
+	case float64:
+		return big.NewFloat(value).Text('f', -1), true
+	case bool:
+		return fmt.Sprint(value), true
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			values = append(values, fmt.Sprint(item))
+		}
+		return strings.Join(values, ","), true
+	default:
+		return "", false
+	}
+}
+
+func (c Claims) time(name string) (time.Time, bool) {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(value), 0), true
+}
+
+func (c Claims) audience() []string {
+	switch value := c["aud"].(type) {
+	case string:
+		return []string{value}
+	case []any:
+		audience := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+		return audience
+	default:
+		return nil
+	}
+}
+
+// Options describes how the claims of a token are validated. Tokens
+// without exp are rejected, unless AllowMissingExp is set.
+type Options struct {
+	Issuer          string
+	Audience        string
+	Algorithms      []string
+	Leeway          time.Duration
+	AllowMissingExp bool
+	Now             func() time.Time
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks the signature of token using keys and validates its claims
+func Verify(token string, keys *KeySet, opts Options) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, err
+	}
+
+	if !isAllowed(h.Alg, opts.Algorithms) {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlg, h.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	key, ok := keys.find(h.Kid, h.Alg)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	if err := verifySignature(h.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := validate(claims, opts); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func isAllowed(alg string, algorithms []string) bool {
+	if len(algorithms) == 0 {
+		algorithms = []string{HS256, RS256, ES256}
+	}
+
+	for _, allowed := range algorithms {
+		if allowed == alg {
+			return true
+		}
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+func verifySignature(alg string, key any, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case HS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrInvalidSignature
+		}
+	case RS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+	case ES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		// JWS encodes the signature as r || s, each 32 bytes for P-256
+		if len(signature) != 64 {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(publicKey, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return ErrUnsupportedAlg
+	}
+
+	return nil
+}
+
+func validate(claims Claims, opts Options) error {
+	now := time.Now()
+	if opts.Now != nil {
+		now = opts.Now()
+	}
+
+	exp, ok := claims.time("exp")
+	if !ok && !opts.AllowMissingExp {
+		return ErrMissingExp
+	}
+
+	if ok && now.After(exp.Add(opts.Leeway)) {
+		return ErrExpired
+	}
+
+	if nbf, ok := claims.time("nbf"); ok && now.Before(nbf.Add(-opts.Leeway)) {
+		return ErrNotValidYet
+	}
+
+	if opts.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != opts.Issuer {
+			return ErrInvalidIssuer
+		}
+	}
+
+	if opts.Audience != "" {
+		found := false
+		for _, aud := range claims.audience() {
+			if aud == opts.Audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrInvalidAudience
+		}
+	}
+
+	return nil
+}
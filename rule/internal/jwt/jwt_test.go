@@ -0,0 +1,205 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeSegment(t *testing.T, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func sign(t *testing.T, alg string, kid string, key any, claims map[string]any) string {
+	signed := encodeSegment(t, map[string]string{"alg": alg, "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+
+	switch alg {
+	case HS256:
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case RS256:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "oct", "kid": "hs", "k": %q},
+		{"kty": "RSA", "kid": "rs", "use": "sig", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "es", "crv": "P-256", "x": %q, "y": %q},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": %q, "e": %q}
+	]}`,
+		b64(secret),
+		b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		b64(ecKey.X.Bytes()), b64(ecKey.Y.Bytes()),
+		b64(rsaKey.N.Bytes()), b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+	)
+
+	keys, err := ParseJWKS([]byte(jwks))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, keys.Len())
+
+	now := time.Now()
+	valid := map[string]any{
+		"sub": "user-1",
+		"iss": "https://auth.example.com",
+		"aud": []string{"api", "web"},
+		"exp": now.Add(time.Hour).Unix(),
+	}
+
+	opts := Options{
+		Issuer:   "https://auth.example.com",
+		Audience: "api",
+	}
+
+	testCases := []struct {
+		name  string
+		token string
+		opts  Options
+		err   error
+	}{
+		{
+			name:  "HS256",
+			token: sign(t, HS256, "hs", secret, valid),
+			opts:  opts,
+		},
+		{
+			name:  "RS256",
+			token: sign(t, RS256, "rs", rsaKey, valid),
+			opts:  opts,
+		},
+		{
+			name:  "ES256",
+			token: sign(t, ES256, "es", ecKey, valid),
+			opts:  opts,
+		},
+		{
+			name:  "wrong key",
+			token: sign(t, HS256, "hs", []byte("other"), valid),
+			opts:  opts,
+			err:   ErrInvalidSignature,
+		},
+		{
+			name:  "unknown kid",
+			token: sign(t, RS256, "enc", rsaKey, valid),
+			opts:  opts,
+			err:   ErrKeyNotFound,
+		},
+		{
+			name:  "algorithm not allowed",
+			token: sign(t, HS256, "hs", secret, valid),
+			opts:  Options{Algorithms: []string{RS256}},
+			err:   ErrUnsupportedAlg,
+		},
+		{
+			name:  "expired",
+			token: sign(t, HS256, "hs", secret, map[string]any{"exp": now.Add(-time.Hour).Unix()}),
+			opts:  Options{},
+			err:   ErrExpired,
+		},
+		{
+			name:  "not valid yet",
+			token: sign(t, HS256, "hs", secret, map[string]any{"nbf": now.Add(time.Hour).Unix(), "exp": now.Add(2 * time.Hour).Unix()}),
+			opts:  Options{},
+			err:   ErrNotValidYet,
+		},
+		{
+			name:  "no expiration",
+			token: sign(t, HS256, "hs", secret, map[string]any{"sub": "user-1"}),
+			opts:  Options{},
+			err:   ErrMissingExp,
+		},
+		{
+			name:  "no expiration allowed",
+			token: sign(t, HS256, "hs", secret, map[string]any{"sub": "user-1", "aud": []string{"api", "web"}}),
+			opts:  Options{AllowMissingExp: true},
+		},
+		{
+			name:  "wrong issuer",
+			token: sign(t, HS256, "hs", secret, valid),
+			opts:  Options{Issuer: "https://other.example.com"},
+			err:   ErrInvalidIssuer,
+		},
+		{
+			name:  "wrong audience",
+			token: sign(t, HS256, "hs", secret, valid),
+			opts:  Options{Audience: "admin"},
+			err:   ErrInvalidAudience,
+		},
+		{
+			name:  "malformed",
+			token: "a.b",
+			opts:  opts,
+			err:   ErrMalformed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims, err := Verify(tc.token, keys, tc.opts)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+				return
+			}
+
+			assert.NoError(t, err)
+			sub, _ := claims.String("sub")
+			assert.Equal(t, "user-1", sub)
+			aud, _ := claims.String("aud")
+			assert.Equal(t, "api,web", aud)
+			exp, _ := claims.String("exp")
+			assert.False(t, strings.Contains(exp, "e+"))
+		})
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"strings"
 	"time"
+
+	"github.com/alinz/baker.go/rule/internal/realip"
 )
 
 func Limit(requestLimit int, windowLength time.Duration, options ...Option) func(next http.Handler) http.Handler {
@@ -35,27 +37,7 @@ func KeyByIP(r *http.Request) (string, error) {
 }
 
 func KeyByRealIP(r *http.Request) (string, error) {
-	var ip string
-
-	if tcip := r.Header.Get("True-Client-IP"); tcip != "" {
-		ip = tcip
-	} else if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-		ip = xrip
-	} else if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		i := strings.Index(xff, ", ")
-		if i == -1 {
-			i = len(xff)
-		}
-		ip = xff[:i]
-	} else {
-		var err error
-		ip, _, err = net.SplitHostPort(r.RemoteAddr)
-		if err != nil {
-			ip = r.RemoteAddr
-		}
-	}
-
-	return canonicalizeIP(ip), nil
+	return canonicalizeIP(realip.ClientIP(r, realip.TrustAll, "")), nil
 }
 
 func KeyByEndpoint(r *http.Request) (string, error) {
@@ -0,0 +1,100 @@
+package realip
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustFunc reports whether addr is a proxy whose headers can be trusted
+type TrustFunc func(addr netip.Addr) bool
+
+// TrustAll trusts every proxy, headers can easily be spoofed by clients,
+// so it should only be used when baker is always behind a proxy
+func TrustAll(addr netip.Addr) bool {
+	return true
+}
+
+// TrustPrefixes only trusts proxies within prefixes
+func TrustPrefixes(prefixes []netip.Prefix) TrustFunc {
+	return func(addr netip.Addr) bool {
+		addr = addr.Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ParsePrefixes parses a list of CIDRs, plain addresses are
+// treated as a single address prefix
+func ParsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+// RemoteIP returns the ip of the connection
+func RemoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// ClientIP returns the ip of the client. The proxy headers are only used if the
+// connection comes from a trusted proxy. X-Forwarded-For is walked from right to
+// left, skipping trusted proxies, as the addresses on the left were sent by the
+// client. header, if set, is a single value header, e.g. X-Real-IP, set by the
+// trusted proxies, it is only safe if they overwrite it instead of passing it through.
+func ClientIP(r *http.Request, trusted TrustFunc, header string) string {
+	ip := RemoteIP(r)
+
+	// an unknown peer, e.g. a unix socket, is never a trusted proxy
+	if addr, err := netip.ParseAddr(ip); err != nil || !trusted(addr) {
+		return ip
+	}
+
+	if header != "" {
+		if value := strings.TrimSpace(r.Header.Get(header)); value != "" {
+			return value
+		}
+	}
+
+	var xff []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		xff = append(xff, strings.Split(value, ",")...)
+	}
+
+	for i := len(xff) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(xff[i])
+
+		addr, err := netip.ParseAddr(ip)
+		if i == 0 || err != nil || !trusted(addr) {
+			return ip
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,96 @@
+package realip
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParsePrefixes([]string{"10.0.0.0/8", "fd00::/8", "192.168.1.1"})
+	assert.NoError(t, err)
+
+	trusted := TrustPrefixes(proxies)
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		trusted    TrustFunc
+		header     string
+		want       string
+	}{
+		{
+			name:       "headers of an untrusted connection are ignored",
+			remoteAddr: "203.0.113.7:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Real-IP": "1.1.1.1"},
+			trusted:    trusted,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "rightmost untrusted address of X-Forwarded-For",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.2, 10.0.0.2"},
+			trusted:    trusted,
+			want:       "198.51.100.2",
+		},
+		{
+			name:       "X-Real-IP passed through by a trusted proxy is ignored",
+			remoteAddr: "192.168.1.1:1234",
+			headers:    map[string]string{"X-Real-IP": "10.0.0.1", "True-Client-IP": "10.0.0.1", "X-Forwarded-For": "203.0.113.7"},
+			trusted:    trusted,
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "header set by a trusted proxy",
+			remoteAddr: "192.168.1.1:1234",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.2", "X-Forwarded-For": "203.0.113.7"},
+			trusted:    trusted,
+			header:     "X-Real-IP",
+			want:       "198.51.100.2",
+		},
+		{
+			name:       "header of an untrusted connection is ignored",
+			remoteAddr: "203.0.113.7:1234",
+			headers:    map[string]string{"X-Real-IP": "10.0.0.1"},
+			trusted:    trusted,
+			header:     "X-Real-IP",
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "headers of an unknown peer are ignored",
+			remoteAddr: "@",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1", "X-Real-IP": "1.1.1.1"},
+			trusted:    TrustAll,
+			header:     "X-Real-IP",
+			want:       "@",
+		},
+		{
+			name:       "IPv6 proxy",
+			remoteAddr: "[fd00::1]:1234",
+			headers:    map[string]string{"X-Forwarded-For": "2001:db8::1"},
+			trusted:    trusted,
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "trust all uses the leftmost address",
+			remoteAddr: "203.0.113.7:1234",
+			headers:    map[string]string{"X-Forwarded-For": "1.1.1.1, 198.51.100.2"},
+			trusted:    TrustAll,
+			want:       "1.1.1.1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+
+			assert.Equal(t, tc.want, ClientIP(r, tc.trusted, tc.header))
+		})
+	}
+}
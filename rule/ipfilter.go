@@ -0,0 +1,126 @@
+package rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+
+	"github.com/alinz/baker.go/pkg/log"
+	"github.com/alinz/baker.go/rule/internal/realip"
+)
+
+const IPFilterName = "IPFilter"
+
+// IPFilter allows or denies requests by the ip of the client, using IPv4 or IPv6
+// CIDRs. Deny is checked first, then if Allow is not empty, the client must be
+// in one of its ranges. The client ip is the ip of the connection, unless it comes
+// from one of the TrustedProxies, in which case it is taken from X-Forwarded-For,
+// or from ClientIPHeader if set, which the proxies must overwrite.
+type IPFilter struct {
+	Allow          []string `json:"allow"`
+	Deny           []string `json:"deny"`
+	TrustedProxies []string `json:"trusted_proxies"`
+	ClientIPHeader string   `json:"client_ip_header"`
+	allow          []netip.Prefix
+	deny           []netip.Prefix
+	trusted        realip.TrustFunc
+}
+
+var _ Middleware = (*IPFilter)(nil)
+
+func (f *IPFilter) IsCachable() bool {
+	return false
+}
+
+func (f *IPFilter) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *IPFilter) isAllowed(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	if contains(f.deny, addr) {
+		return false
+	}
+
+	return len(f.allow) == 0 || contains(f.allow, addr)
+}
+
+func (f *IPFilter) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := realip.ClientIP(r, f.trusted, f.ClientIPHeader)
+
+		if !f.isAllowed(ip) {
+			log.Debug().
+				Str("type", IPFilterName).
+				Str("ip", ip).
+				Msg("request is denied")
+			Error(w, r, http.StatusForbidden, "forbidden")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NewIPFilter(allow []string, deny []string, trustedProxies []string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: IPFilterName,
+		Args: IPFilter{
+			Allow:          allow,
+			Deny:           deny,
+			TrustedProxies: trustedProxies,
+		},
+	}
+}
+
+func RegisterIPFilter() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[IPFilterName] = func(raw json.RawMessage) (Middleware, error) {
+			ipFilter := &IPFilter{}
+			err := json.Unmarshal(raw, ipFilter)
+			if err != nil {
+				return nil, err
+			}
+
+			ipFilter.allow, err = realip.ParsePrefixes(ipFilter.Allow)
+			if err != nil {
+				return nil, err
+			}
+
+			ipFilter.deny, err = realip.ParsePrefixes(ipFilter.Deny)
+			if err != nil {
+				return nil, err
+			}
+
+			trustedProxies, err := realip.ParsePrefixes(ipFilter.TrustedProxies)
+			if err != nil {
+				return nil, err
+			}
+			ipFilter.trusted = realip.TrustPrefixes(trustedProxies)
+
+			return ipFilter, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,267 @@
+package rule
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+	"github.com/alinz/baker.go/rule/internal/jwt"
+	"golang.org/x/sync/singleflight"
+)
+
+const JWTName = "JWT"
+
+const (
+	defaultJWKSRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits how often the keys are reloaded
+	// when a token is signed by an unknown key
+	jwksMinRefreshInterval = time.Minute
+)
+
+var jwksClient = &http.Client{
+	Timeout: 5 * time.Second,
+}
+
+// JWT validates bearer tokens signed using HS256, RS256 or ES256. Keys are either
+// a shared Secret or loaded from a JWKS file or URL, which are reloaded every
+// RefreshInterval. ClaimHeaders maps claims to the headers used to forward them
+// to the container, the headers are removed from the incoming request first, so
+// they can't be spoofed by the client. Tokens without exp are rejected unless
+// RequireExp is false.
+type JWT struct {
+	Secret          string            `json:"secret"`
+	JWKSFile        string            `json:"jwks_file"`
+	JWKSURL         string            `json:"jwks_url"`
+	RefreshInterval Duration          `json:"refresh_interval"`
+	Issuer          string            `json:"issuer"`
+	Audience        string            `json:"audience"`
+	Algorithms      []string          `json:"algorithms"`
+	Leeway          Duration          `json:"leeway"`
+	RequireExp      *bool             `json:"require_exp"`
+	ClaimHeaders    map[string]string `json:"claim_headers"`
+	Realm           string            `json:"realm"`
+	keys            *jwt.KeySet
+	loadedAt        time.Time
+	mu              sync.Mutex
+	loads           singleflight.Group
+}
+
+var _ Middleware = (*JWT)(nil)
+
+// JWT is cachable, so the keys are not loaded for every request
+func (j *JWT) IsCachable() bool {
+	return true
+}
+
+func (j *JWT) UpdateMiddelware(newImpl Middleware) Middleware {
+	if newImpl == nil {
+		return j
+	}
+
+	newJ, ok := newImpl.(*JWT)
+	if !ok {
+		log.Error().
+			Str("type", JWTName).
+			Msg("failed to update middleware")
+		return j
+	}
+
+	if argsKey(j) == argsKey(newJ) {
+		return j
+	}
+
+	log.Debug().
+		Str("type", JWTName).
+		Msg("updating middleware")
+
+	return newJ
+}
+
+func (j *JWT) loadKeys() (*jwt.KeySet, error) {
+	if j.Secret != "" {
+		return jwt.NewSecret([]byte(j.Secret)), nil
+	}
+
+	var data []byte
+	var err error
+
+	switch {
+	case j.JWKSFile != "":
+		data, err = os.ReadFile(j.JWKSFile)
+	case j.JWKSURL != "":
+		var resp *http.Response
+		resp, err = jwksClient.Get(j.JWKSURL)
+		if err != nil {
+			break
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+			break
+		}
+		data, err = io.ReadAll(resp.Body)
+	default:
+		err = fmt.Errorf("one of secret, jwks_file or jwks_url is required")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.ParseJWKS(data)
+}
+
+// getKeys returns the current keys, they are reloaded once RefreshInterval
+// has passed, or if force is set. If reloading fails, the old keys are kept.
+// The keys are loaded once at a time, and without holding back the requests
+// while old keys can be used, unless force is set.
+func (j *JWT) getKeys(force bool) (*jwt.KeySet, error) {
+	j.mu.Lock()
+	keys, loadedAt := j.keys, j.loadedAt
+	j.mu.Unlock()
+
+	refreshInterval := j.RefreshInterval.Duration
+	if refreshInterval <= 0 {
+		refreshInterval = defaultJWKSRefreshInterval
+	}
+
+	age := time.Since(loadedAt)
+	if keys != nil && age < refreshInterval && !(force && age >= jwksMinRefreshInterval) {
+		return keys, nil
+	}
+
+	loads := j.loads.DoChan("keys", func() (any, error) {
+		keys, err := j.loadKeys()
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("type", JWTName).
+				Msg("failed to load keys")
+			return nil, err
+		}
+
+		j.mu.Lock()
+		j.keys = keys
+		j.loadedAt = time.Now()
+		j.mu.Unlock()
+
+		return keys, nil
+	})
+
+	if keys != nil && !force {
+		return keys, nil
+	}
+
+	result := <-loads
+	if result.Err != nil {
+		if keys == nil {
+			return nil, result.Err
+		}
+		return keys, nil
+	}
+
+	return result.Val.(*jwt.KeySet), nil
+}
+
+func (j *JWT) verify(token string) (jwt.Claims, error) {
+	keys, err := j.getKeys(false)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := jwt.Options{
+		Issuer:     j.Issuer,
+		Audience:   j.Audience,
+		Algorithms: j.Algorithms,
+		Leeway:     j.Leeway.Duration,
+		// required unless explicitly disabled
+		AllowMissingExp: j.RequireExp != nil && !*j.RequireExp,
+	}
+
+	claims, err := jwt.Verify(token, keys, opts)
+	if errors.Is(err, jwt.ErrKeyNotFound) && j.Secret == "" {
+		// the keys might have been rotated
+		keys, err = j.getKeys(true)
+		if err != nil {
+			return nil, err
+		}
+		claims, err = jwt.Verify(token, keys, opts)
+	}
+
+	return claims, err
+}
+
+func (j *JWT) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range j.ClaimHeaders {
+			r.Header.Del(header)
+		}
+
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			unauthorized(w, r, fmt.Sprintf(`Bearer realm=%q`, realm(j.Realm)))
+			return
+		}
+
+		claims, err := j.verify(strings.TrimSpace(token))
+		if err != nil {
+			log.Debug().
+				Err(err).
+				Str("type", JWTName).
+				Msg("invalid token")
+			unauthorized(w, r, fmt.Sprintf(`Bearer realm=%q, error="invalid_token", error_description=%q`, realm(j.Realm), err.Error()))
+			return
+		}
+
+		for claim, header := range j.ClaimHeaders {
+			if value, ok := claims.String(claim); ok {
+				r.Header.Set(header, value)
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NewJWT(secret string, issuer string, audience string, claimHeaders map[string]string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: JWTName,
+		Args: &JWT{
+			Secret:       secret,
+			Issuer:       issuer,
+			Audience:     audience,
+			ClaimHeaders: claimHeaders,
+		},
+	}
+}
+
+func RegisterJWT() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[JWTName] = func(raw json.RawMessage) (Middleware, error) {
+			j := &JWT{}
+			err := json.Unmarshal(raw, j)
+			if err != nil {
+				return nil, err
+			}
+			if j.Secret == "" && j.JWKSFile == "" && j.JWKSURL == "" {
+				return nil, fmt.Errorf("one of secret, jwks_file or jwks_url is required")
+			}
+			return j, nil
+		}
+
+		return nil
+	}
+}
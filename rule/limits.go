@@ -0,0 +1,206 @@
+package rule
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const LimitsName = "Limits"
+
+// ErrIdleTimeout is the cause of the cancellation of a request whose
+// response stopped streaming for longer than the idle timeout
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// Limits protects a route against huge requests and slow containers. Requests
+// whose body is bigger than MaxBodySize are rejected with 413, and requests whose
+// header is bigger than MaxHeaderSize with 431. If the container doesn't respond
+// within Timeout, a 504 is returned. Once the response is streamed, it is aborted
+// if nothing is sent for IdleTimeout.
+type Limits struct {
+	MaxBodySize   int64    `json:"max_body_size"`
+	MaxHeaderSize int      `json:"max_header_size"`
+	Timeout       Duration `json:"timeout"`
+	IdleTimeout   Duration `json:"idle_timeout"`
+}
+
+var _ Middleware = (*Limits)(nil)
+
+func (l *Limits) IsCachable() bool {
+	return false
+}
+
+func (l *Limits) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+// headerSize is the size of the request line and the header
+// as they were sent by the client
+func headerSize(r *http.Request) int {
+	size := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	for name, values := range r.Header {
+		for _, value := range values {
+			size += len(name) + len(value) + 4
+		}
+	}
+	return size
+}
+
+func (l *Limits) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.MaxHeaderSize > 0 && headerSize(r) > l.MaxHeaderSize {
+			Error(w, r, http.StatusRequestHeaderFieldsTooLarge, "request header is too large")
+			return
+		}
+
+		if l.MaxBodySize > 0 {
+			if r.ContentLength > l.MaxBodySize {
+				Error(w, r, http.StatusRequestEntityTooLarge, "request body is too large")
+				return
+			}
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, l.MaxBodySize)
+			}
+		}
+
+		if l.Timeout.Duration <= 0 && l.IdleTimeout.Duration <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithCancelCause(r.Context())
+		defer cancel(nil)
+
+		lw := &limitsWriter{
+			ResponseWriter: w,
+			idleTimeout:    l.IdleTimeout.Duration,
+			cancel:         cancel,
+		}
+		defer lw.stop()
+
+		if l.Timeout.Duration > 0 {
+			// the cause is used by baker to respond with 504
+			lw.timer = time.AfterFunc(l.Timeout.Duration, func() {
+				cancel(context.DeadlineExceeded)
+			})
+		}
+
+		next.ServeHTTP(lw, r.WithContext(ctx))
+	})
+}
+
+// limitsWriter stops the response timer once the header is written,
+// then resets the idle timer on every write
+type limitsWriter struct {
+	http.ResponseWriter
+	idleTimeout time.Duration
+	cancel      context.CancelCauseFunc
+	mu          sync.Mutex
+	timer       *time.Timer
+	wroteHeader bool
+}
+
+var _ http.ResponseWriter = (*limitsWriter)(nil)
+var _ http.Flusher = (*limitsWriter)(nil)
+var _ http.Hijacker = (*limitsWriter)(nil)
+
+func (lw *limitsWriter) stop() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if lw.timer != nil {
+		lw.timer.Stop()
+		lw.timer = nil
+	}
+}
+
+func (lw *limitsWriter) touch() {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	if !lw.wroteHeader {
+		lw.wroteHeader = true
+
+		if lw.timer != nil {
+			lw.timer.Stop()
+			lw.timer = nil
+		}
+
+		if lw.idleTimeout > 0 {
+			lw.timer = time.AfterFunc(lw.idleTimeout, func() {
+				lw.cancel(ErrIdleTimeout)
+			})
+		}
+
+		return
+	}
+
+	if lw.timer != nil {
+		lw.timer.Reset(lw.idleTimeout)
+	}
+}
+
+func (lw *limitsWriter) WriteHeader(statusCode int) {
+	if statusCode >= 200 || statusCode == http.StatusSwitchingProtocols {
+		lw.touch()
+	}
+	lw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (lw *limitsWriter) Write(b []byte) (int, error) {
+	lw.touch()
+	return lw.ResponseWriter.Write(b)
+}
+
+func (lw *limitsWriter) Flush() {
+	lw.touch()
+	http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+// Hijack stops the timers, upgraded connections are not limited
+func (lw *limitsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	lw.stop()
+	return http.NewResponseController(lw.ResponseWriter).Hijack()
+}
+
+func (lw *limitsWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+func NewLimits(maxBodySize int64, maxHeaderSize int, timeout time.Duration, idleTimeout time.Duration) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: LimitsName,
+		Args: Limits{
+			MaxBodySize:   maxBodySize,
+			MaxHeaderSize: maxHeaderSize,
+			Timeout:       Duration{Duration: timeout},
+			IdleTimeout:   Duration{Duration: idleTimeout},
+		},
+	}
+}
+
+func RegisterLimits() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[LimitsName] = func(raw json.RawMessage) (Middleware, error) {
+			limits := &Limits{}
+			err := json.Unmarshal(raw, limits)
+			if err != nil {
+				return nil, err
+			}
+			return limits, nil
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,150 @@
+package rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alinz/baker.go/pkg/log"
+)
+
+const MaintenanceName = "Maintenance"
+
+var defaultMaintenanceBypassPaths = []string{"/health", "/healthz"}
+
+// Maintenance serves a maintenance page instead of sending the request to the
+// container. It is active if Enabled is set in the configuration of the container,
+// or if maintenance is enabled for the domain using the admin API. Requests whose
+// path is one of BypassPaths or below one of them, `/health` and `/healthz` by
+// default, are still sent to the container, so health checks keep passing.
+type Maintenance struct {
+	Enabled     bool     `json:"enabled"`
+	StatusCode  int      `json:"status_code"`
+	RetryAfter  Duration `json:"retry_after"`
+	BypassPaths []string `json:"bypass_paths"`
+	content
+}
+
+var (
+	_ Middleware = (*Maintenance)(nil)
+	_ Reloader   = (*Maintenance)(nil)
+)
+
+// DefaultMaintenance returns an enabled maintenance rule, used for the domains
+// put in maintenance using the admin API whose endpoints don't have one
+func DefaultMaintenance() *Maintenance {
+	m := &Maintenance{Enabled: true}
+	m.setDefaults()
+	return m
+}
+
+func (m *Maintenance) setDefaults() {
+	if m.StatusCode == 0 {
+		m.StatusCode = http.StatusServiceUnavailable
+	}
+	if m.BypassPaths == nil {
+		m.BypassPaths = defaultMaintenanceBypassPaths
+	}
+}
+
+// Maintenance is cachable, so the body file is not read for every request
+func (m *Maintenance) IsCachable() bool {
+	return true
+}
+
+func (m *Maintenance) UpdateMiddelware(newImpl Middleware) Middleware {
+	if newImpl == nil {
+		m.load(MaintenanceName)
+		return m
+	}
+
+	newM, ok := newImpl.(*Maintenance)
+	if !ok {
+		log.Error().
+			Str("type", MaintenanceName).
+			Msg("failed to update middleware")
+		return m
+	}
+
+	if argsKey(m) == argsKey(newM) {
+		m.load(MaintenanceName)
+		return m
+	}
+
+	newM.load(MaintenanceName)
+	return newM
+}
+
+func (m *Maintenance) Reload() {
+	m.reload(MaintenanceName)
+}
+
+func (m *Maintenance) isBypassed(path string) bool {
+	for _, prefix := range m.BypassPaths {
+		// `/health` bypasses `/health/live`, but not `/healthcare`
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Maintenance) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active := m.Enabled || GetRequestInfo(r.Context()).Maintenance
+		if !active || m.isBypassed(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if m.RetryAfter.Duration > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(m.RetryAfter.Seconds())))
+		}
+		w.Header().Set("Cache-Control", "no-store")
+
+		// without a page, the error page of the domain is used
+		if m.Body == "" && m.BodyFile == "" {
+			Error(w, r, m.StatusCode, "service is under maintenance")
+			return
+		}
+
+		m.write(w, r, m.StatusCode)
+	})
+}
+
+func NewMaintenance(enabled bool, body string, contentType string, bypassPaths []string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: MaintenanceName,
+		Args: &Maintenance{
+			Enabled:     enabled,
+			BypassPaths: bypassPaths,
+			content: content{
+				Body:        body,
+				ContentType: contentType,
+			},
+		},
+	}
+}
+
+func RegisterMaintenance() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[MaintenanceName] = func(raw json.RawMessage) (Middleware, error) {
+			maintenance := &Maintenance{}
+			err := json.Unmarshal(raw, maintenance)
+			if err != nil {
+				return nil, err
+			}
+			maintenance.setDefaults()
+			return maintenance, nil
+		}
+
+		return nil
+	}
+}
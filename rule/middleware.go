@@ -11,6 +11,12 @@ type Middleware interface {
 	UpdateMiddelware(newImpl Middleware) Middleware
 }
 
+// Reloader is implemented by the cachable middlewares which read files, they
+// are reloaded periodically, instead of checking the files for every request
+type Reloader interface {
+	Reload()
+}
+
 type BuilderFunc func(raw json.RawMessage) (Middleware, error)
 type RegisterFunc func(map[string]BuilderFunc) error
 
@@ -0,0 +1,228 @@
+package rule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+)
+
+const MirrorName = "Mirror"
+
+// MirrorHeader is set on shadow requests, so their upstream can tell them
+// apart. Baker removes it from the requests it receives, see IsMirrored.
+const MirrorHeader = "X-Baker-Mirror"
+
+const (
+	defaultMirrorMaxBodyBytes = 1 << 20
+	defaultMirrorTimeout      = 10 * time.Second
+	maxInflightMirrors        = 128
+)
+
+// inflightMirrors limits the number of shadow requests in flight,
+// once it is full, requests are not mirrored until some of them are done
+var inflightMirrors = make(chan struct{}, maxInflightMirrors)
+
+var mirrorClient = &http.Client{}
+
+// Mirror duplicates a percentage of requests to another domain registered
+// in baker, or to a fixed address if Addr is set. The shadow response is discarded.
+// Requests with a body larger than MaxBodyBytes are not mirrored, and shadow
+// requests are never mirrored again. Percentage is required, up to 100.
+type Mirror struct {
+	Percentage   float64  `json:"percentage"`
+	Domain       string   `json:"domain"`
+	Addr         string   `json:"addr"`
+	Path         string   `json:"path"`
+	MaxBodyBytes int64    `json:"max_body_bytes"`
+	Timeout      Duration `json:"timeout"`
+}
+
+var _ Middleware = (*Mirror)(nil)
+
+func (m *Mirror) IsCachable() bool {
+	return false
+}
+
+func (m *Mirror) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (m *Mirror) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if IsMirrored(r.Context()) || rand.Float64()*100 >= m.Percentage {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, ok := m.bufferBody(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case inflightMirrors <- struct{}{}:
+			shadow, cancel := m.shadowRequest(r, body)
+			router := Router(r.Context())
+
+			go func() {
+				defer func() { <-inflightMirrors }()
+				defer cancel()
+				m.send(shadow, router)
+			}()
+		default:
+			log.Debug().
+				Str("type", MirrorName).
+				Msg("too many mirrored requests in flight, skipping")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bufferBody reads the body of r, so it can be sent twice. The body of r
+// is replaced, so the primary request is not affected by it.
+func (m *Mirror) bufferBody(r *http.Request) ([]byte, bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true
+	}
+
+	maxBodyBytes := m.MaxBodyBytes
+	if maxBodyBytes <= 0 {
+		maxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+
+	if r.ContentLength > maxBodyBytes {
+		return nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{
+		Reader: io.MultiReader(bytes.NewReader(body), r.Body),
+		Closer: r.Body,
+	}
+
+	if err != nil || int64(len(body)) > maxBodyBytes {
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (m *Mirror) shadowRequest(r *http.Request, body []byte) (*http.Request, context.CancelFunc) {
+	timeout := m.Timeout.Duration
+	if timeout <= 0 {
+		timeout = defaultMirrorTimeout
+	}
+
+	// the shadow request outlives the primary one, so it can't use its context
+	ctx, cancel := context.WithTimeout(withMirrored(context.Background()), timeout)
+
+	shadow := r.Clone(ctx)
+	shadow.Header.Set(MirrorHeader, "1")
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	shadow.RequestURI = ""
+
+	if m.Path != "" {
+		shadow.URL.Path = expandParams(m.Path, r.Context())
+		shadow.URL.RawPath = ""
+	}
+
+	return shadow, cancel
+}
+
+func (m *Mirror) send(shadow *http.Request, router http.Handler) {
+	if m.Addr != "" {
+		shadow.URL.Scheme = "http"
+		shadow.URL.Host = m.Addr
+		shadow.Host = m.Addr
+
+		resp, err := mirrorClient.Do(shadow)
+		if err != nil {
+			log.Debug().
+				Err(err).
+				Str("type", MirrorName).
+				Str("addr", m.Addr).
+				Msg("failed to mirror request")
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return
+	}
+
+	if router == nil {
+		log.Error().
+			Str("type", MirrorName).
+			Msg("no router is available to mirror request")
+		return
+	}
+
+	shadow.Host = m.Domain
+	router.ServeHTTP(&discardResponseWriter{header: make(http.Header)}, shadow)
+}
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(statusCode int) {}
+
+func NewMirror(percentage float64, domain string, addr string, path string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: MirrorName,
+		Args: Mirror{
+			Percentage: percentage,
+			Domain:     domain,
+			Addr:       addr,
+			Path:       path,
+		},
+	}
+}
+
+func RegisterMirror() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[MirrorName] = func(raw json.RawMessage) (Middleware, error) {
+			mirror := &Mirror{}
+			err := json.Unmarshal(raw, mirror)
+			if err != nil {
+				return nil, err
+			}
+			if mirror.Domain == "" && mirror.Addr == "" {
+				return nil, fmt.Errorf("either domain or addr is required")
+			}
+			// a rule without percentage would never mirror anything
+			if mirror.Percentage <= 0 || mirror.Percentage > 100 {
+				return nil, fmt.Errorf("percentage must be greater than 0 and at most 100")
+			}
+			return mirror, nil
+		}
+
+		return nil
+	}
+}
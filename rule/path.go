@@ -27,9 +27,9 @@ func (a *AppendPath) Process(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var bs strings.Builder
 
-		bs.WriteString(a.Begin)
+		bs.WriteString(expandParams(a.Begin, r.Context()))
 		bs.WriteString(r.URL.Path)
-		bs.WriteString(a.End)
+		bs.WriteString(expandParams(a.End, r.Context()))
 
 		r.URL.Path = bs.String()
 
@@ -88,7 +88,8 @@ func (p *ReplacePath) UpdateMiddelware(newImpl Middleware) Middleware {
 
 func (p *ReplacePath) Process(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.URL.Path = strings.Replace(r.URL.Path, p.Search, p.Replace, p.Times)
+		replace := expandParams(p.Replace, r.Context())
+		r.URL.Path = strings.Replace(r.URL.Path, p.Search, replace, p.Times)
 		next.ServeHTTP(w, r)
 	})
 }
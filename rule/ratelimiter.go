@@ -2,7 +2,6 @@ package rule
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"time"
 
@@ -10,30 +9,8 @@ import (
 	"github.com/alinz/baker.go/rule/internal/rate"
 )
 
-type WindowDuration struct {
-	time.Duration
-}
-
-// MarshalJSON implements the json.Marshaler interface for WindowDuration.
-func (d WindowDuration) MarshalJSON() ([]byte, error) {
-	return []byte(fmt.Sprintf(`"%s"`, d.String())), nil
-}
-
-// UnmarshalJSON implements the json.Unmarshaler interface for WindowDuration.
-func (d *WindowDuration) UnmarshalJSON(data []byte) error {
-	if len(data) < 2 {
-		d.Duration = 0
-		return nil
-	}
-
-	duration, err := time.ParseDuration(string(data[1 : len(data)-1]))
-	if err != nil {
-		return err
-	}
-
-	d.Duration = duration
-	return nil
-}
+// WindowDuration is kept for backward compatibility, use Duration instead
+type WindowDuration = Duration
 
 type RateLimiter struct {
 	RequestLimit   int            `json:"request_limit"`
@@ -55,7 +32,7 @@ func (r *RateLimiter) UpdateMiddelware(newImpl Middleware) Middleware {
 			Dur("window_duration", r.WindowDuration.Duration).
 			Msg("initializing for the first time")
 
-		r.middle = rate.LimitByIP(r.RequestLimit, r.WindowDuration.Duration)
+		r.middle = limitByIP(r.RequestLimit, r.WindowDuration.Duration)
 		return r
 	}
 
@@ -83,11 +60,22 @@ func (r *RateLimiter) UpdateMiddelware(newImpl Middleware) Middleware {
 	r.RequestLimit = newR.RequestLimit
 	r.WindowDuration = newR.WindowDuration
 
-	r.middle = rate.LimitByIP(r.RequestLimit, r.WindowDuration.Duration)
+	r.middle = limitByIP(r.RequestLimit, r.WindowDuration.Duration)
 
 	return r
 }
 
+func limitByIP(requestLimit int, windowDuration time.Duration) func(next http.Handler) http.Handler {
+	return rate.Limit(
+		requestLimit,
+		windowDuration,
+		rate.WithKeyByIP(),
+		rate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
+			Error(w, r, http.StatusTooManyRequests, "too many requests")
+		}),
+	)
+}
+
 func (r *RateLimiter) Process(next http.Handler) http.Handler {
 	return r.middle(next)
 }
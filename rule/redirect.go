@@ -0,0 +1,260 @@
+package rule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	RedirectName = "Redirect"
+	RewriteName  = "Rewrite"
+)
+
+// replacePath replaces the matches of re in path by replace, which can refer to the
+// captures using $1 or ${name}, and to the path params using {name}. If re is nil,
+// path is replaced as a whole. The query of the replacement, if any, is returned separately.
+func replacePath(re *regexp.Regexp, path string, replace string, r *http.Request) (string, string, bool) {
+	if re != nil {
+		if !re.MatchString(path) {
+			return "", "", false
+		}
+		replace = re.ReplaceAllString(path, replace)
+	}
+
+	replace = expandParams(replace, r.Context())
+
+	newPath, query, _ := strings.Cut(replace, "?")
+	return newPath, query, true
+}
+
+func joinQuery(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	default:
+		return a + "&" + b
+	}
+}
+
+// Redirect sends the client to another URL. Scheme, Host and Path replace the
+// parts of the request URL, Path can use the captures of Regex, and the path
+// params. If Regex is set, only matching requests are redirected. The query of
+// the request is kept, unless DropQuery is set.
+type Redirect struct {
+	StatusCode int    `json:"status_code"`
+	Scheme     string `json:"scheme"`
+	Host       string `json:"host"`
+	Path       string `json:"path"`
+	Regex      string `json:"regex"`
+	DropQuery  bool   `json:"drop_query"`
+	re         *regexp.Regexp
+}
+
+var _ Middleware = (*Redirect)(nil)
+
+func (rd *Redirect) IsCachable() bool {
+	return false
+}
+
+func (rd *Redirect) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (rd *Redirect) location(r *http.Request) (string, bool) {
+	path := r.URL.Path
+	var query string
+
+	if rd.Path != "" || rd.re != nil {
+		replace := rd.Path
+		if replace == "" {
+			// only the scheme or host are changed
+			replace = "$0"
+		}
+
+		var ok bool
+		path, query, ok = replacePath(rd.re, path, replace, r)
+		if !ok {
+			return "", false
+		}
+	}
+
+	if !rd.DropQuery {
+		query = joinQuery(query, r.URL.RawQuery)
+	}
+
+	// `//host` would be a network path, sending the client to another site
+	if strings.HasPrefix(path, "//") {
+		path = "/" + strings.TrimLeft(path, "/")
+	}
+
+	location := &url.URL{
+		Path:     path,
+		RawQuery: query,
+	}
+
+	if rd.Scheme != "" || rd.Host != "" {
+		location.Scheme = rd.Scheme
+		if location.Scheme == "" {
+			location.Scheme = "http"
+			if r.TLS != nil {
+				location.Scheme = "https"
+			}
+		}
+
+		location.Host = rd.Host
+		if location.Host == "" {
+			location.Host = r.Host
+			// the port belongs to the old scheme
+			if rd.Scheme != "" {
+				if host, _, err := net.SplitHostPort(r.Host); err == nil {
+					location.Host = host
+				}
+			}
+		}
+	}
+
+	return location.String(), true
+}
+
+func (rd *Redirect) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location, ok := rd.location(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		http.Redirect(w, r, location, rd.StatusCode)
+	})
+}
+
+func NewRedirect(statusCode int, scheme string, host string, regex string, path string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: RedirectName,
+		Args: Redirect{
+			StatusCode: statusCode,
+			Scheme:     scheme,
+			Host:       host,
+			Regex:      regex,
+			Path:       path,
+		},
+	}
+}
+
+func RegisterRedirect() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[RedirectName] = func(raw json.RawMessage) (Middleware, error) {
+			redirect := &Redirect{}
+			err := json.Unmarshal(raw, redirect)
+			if err != nil {
+				return nil, err
+			}
+
+			switch redirect.StatusCode {
+			case 0:
+				redirect.StatusCode = http.StatusFound
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				return nil, fmt.Errorf("invalid redirect status code %d", redirect.StatusCode)
+			}
+
+			if redirect.Regex != "" {
+				redirect.re, err = compileRegexp(redirect.Regex)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			return redirect, nil
+		}
+
+		return nil
+	}
+}
+
+// Rewrite changes the path of the request before it is sent to the container.
+// The matches of Regex are replaced by Replace, which can refer to the captures
+// using $1 or ${name}, and to the path params using {name}. If Replace contains
+// a query, it is added to the query of the request.
+type Rewrite struct {
+	Regex   string `json:"regex"`
+	Replace string `json:"replace"`
+	re      *regexp.Regexp
+}
+
+var _ Middleware = (*Rewrite)(nil)
+
+func (rw *Rewrite) IsCachable() bool {
+	return false
+}
+
+func (rw *Rewrite) UpdateMiddelware(newImpl Middleware) Middleware {
+	return nil
+}
+
+func (rw *Rewrite) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, query, ok := replacePath(rw.re, r.URL.Path, rw.Replace, r)
+		if ok {
+			r.URL.Path = path
+			r.URL.RawPath = ""
+			r.URL.RawQuery = joinQuery(query, r.URL.RawQuery)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func NewRewrite(regex string, replace string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: RewriteName,
+		Args: Rewrite{
+			Regex:   regex,
+			Replace: replace,
+		},
+	}
+}
+
+func RegisterRewrite() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[RewriteName] = func(raw json.RawMessage) (Middleware, error) {
+			rewrite := &Rewrite{}
+			err := json.Unmarshal(raw, rewrite)
+			if err != nil {
+				return nil, err
+			}
+
+			if rewrite.Regex == "" {
+				return nil, fmt.Errorf("regex is required")
+			}
+
+			rewrite.re, err = compileRegexp(rewrite.Regex)
+			if err != nil {
+				return nil, err
+			}
+
+			return rewrite, nil
+		}
+
+		return nil
+	}
+}
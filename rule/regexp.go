@@ -0,0 +1,13 @@
+package rule
+
+import (
+	"regexp"
+
+	"github.com/alinz/baker.go/pkg/regexps"
+)
+
+// rules are built for every request, so regular expressions
+// are compiled once and shared between them
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	return regexps.Compile(expr)
+}
@@ -0,0 +1,191 @@
+package rule
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+)
+
+const RespondName = "Respond"
+
+// content is the body of a static response, given inline or loaded from a file.
+// An inline body can reference the request using placeholders, e.g. `{request_id}`.
+type content struct {
+	Body        string `json:"body"`
+	BodyFile    string `json:"body_file"`
+	ContentType string `json:"content_type"`
+	data        []byte
+	modTime     time.Time
+	loaded      bool
+	mu          sync.RWMutex
+}
+
+// load reads BodyFile the first time, afterwards it is only read by reload,
+// so requests don't touch the filesystem
+func (c *content) load(ruleType string) {
+	if c.BodyFile == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+
+	c.read(ruleType)
+}
+
+// reload reads BodyFile, if it was modified since the last time it was read
+func (c *content) reload(ruleType string) {
+	if c.BodyFile == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.read(ruleType)
+}
+
+func (c *content) read(ruleType string) {
+	info, err := os.Stat(c.BodyFile)
+	if err == nil && c.data != nil && info.ModTime().Equal(c.modTime) {
+		return
+	}
+
+	data, err := os.ReadFile(c.BodyFile)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("type", ruleType).
+			Str("path", c.BodyFile).
+			Msg("failed to load body file")
+		return
+	}
+
+	c.data = data
+	if info != nil {
+		c.modTime = info.ModTime()
+	}
+}
+
+func (c *content) write(w http.ResponseWriter, r *http.Request, statusCode int) {
+	c.mu.RLock()
+	body := c.data
+	c.mu.RUnlock()
+
+	if c.BodyFile == "" {
+		body = []byte(expandRequest(c.Body, r))
+	}
+
+	if c.ContentType != "" {
+		w.Header().Set("Content-Type", c.ContentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(statusCode)
+
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// Respond returns a fixed response without sending the request to the container.
+// The body is either inline, or loaded from BodyFile, which is reloaded once it is
+// modified, see Reloader. Header values can reference the request, e.g. `{request_id}`.
+type Respond struct {
+	StatusCode int               `json:"status_code"`
+	Headers    map[string]string `json:"headers"`
+	content
+}
+
+var (
+	_ Middleware = (*Respond)(nil)
+	_ Reloader   = (*Respond)(nil)
+)
+
+// Respond is cachable, so the body file is not read for every request
+func (rs *Respond) IsCachable() bool {
+	return true
+}
+
+func (rs *Respond) UpdateMiddelware(newImpl Middleware) Middleware {
+	if newImpl == nil {
+		rs.load(RespondName)
+		return rs
+	}
+
+	newRs, ok := newImpl.(*Respond)
+	if !ok {
+		log.Error().
+			Str("type", RespondName).
+			Msg("failed to update middleware")
+		return rs
+	}
+
+	if argsKey(rs) == argsKey(newRs) {
+		rs.load(RespondName)
+		return rs
+	}
+
+	newRs.load(RespondName)
+	return newRs
+}
+
+func (rs *Respond) Reload() {
+	rs.reload(RespondName)
+}
+
+func (rs *Respond) Process(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range rs.Headers {
+			w.Header().Set(name, expandRequest(value, r))
+		}
+
+		rs.write(w, r, rs.StatusCode)
+	})
+}
+
+func NewRespond(statusCode int, headers map[string]string, body string) struct {
+	Type string `json:"type"`
+	Args any    `json:"args"`
+} {
+	return struct {
+		Type string `json:"type"`
+		Args any    `json:"args"`
+	}{
+		Type: RespondName,
+		Args: &Respond{
+			StatusCode: statusCode,
+			Headers:    headers,
+			content: content{
+				Body: body,
+			},
+		},
+	}
+}
+
+func RegisterRespond() RegisterFunc {
+	return func(m map[string]BuilderFunc) error {
+		m[RespondName] = func(raw json.RawMessage) (Middleware, error) {
+			respond := &Respond{}
+			err := json.Unmarshal(raw, respond)
+			if err != nil {
+				return nil, err
+			}
+			if respond.StatusCode == 0 {
+				respond.StatusCode = http.StatusOK
+			}
+			return respond, nil
+		}
+
+		return nil
+	}
+}
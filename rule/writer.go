@@ -0,0 +1,114 @@
+package rule
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+)
+
+// hookWriter calls beforeWriteHeader once, right before the header is written,
+// which gives rules a chance to modify the upstream response header
+type hookWriter struct {
+	http.ResponseWriter
+	beforeWriteHeader func(statusCode int)
+	wroteHeader       bool
+}
+
+var _ http.ResponseWriter = (*hookWriter)(nil)
+var _ http.Flusher = (*hookWriter)(nil)
+var _ http.Hijacker = (*hookWriter)(nil)
+
+func (h *hookWriter) WriteHeader(statusCode int) {
+	if !h.wroteHeader {
+		h.wroteHeader = true
+		h.beforeWriteHeader(statusCode)
+	}
+	h.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (h *hookWriter) Write(b []byte) (int, error) {
+	if !h.wroteHeader {
+		h.WriteHeader(http.StatusOK)
+	}
+	return h.ResponseWriter.Write(b)
+}
+
+func (h *hookWriter) Flush() {
+	if !h.wroteHeader {
+		h.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(h.ResponseWriter).Flush()
+}
+
+// Hijack is used by upgraded connections, e.g. WebSocket, which write
+// the response header directly to the connection
+func (h *hookWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if !h.wroteHeader {
+		h.wroteHeader = true
+		h.beforeWriteHeader(http.StatusSwitchingProtocols)
+	}
+	return http.NewResponseController(h.ResponseWriter).Hijack()
+}
+
+func (h *hookWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+// bufferWriter keeps the response in memory, the body is truncated
+// once it reaches maxBodyBytes
+type bufferWriter struct {
+	header       http.Header
+	statusCode   int
+	body         bytes.Buffer
+	maxBodyBytes int
+}
+
+var _ http.ResponseWriter = (*bufferWriter)(nil)
+
+func newBufferWriter(maxBodyBytes int) *bufferWriter {
+	return &bufferWriter{
+		header:       make(http.Header),
+		maxBodyBytes: maxBodyBytes,
+	}
+}
+
+func (b *bufferWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferWriter) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+}
+
+func (b *bufferWriter) Write(p []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.statusCode = http.StatusOK
+	}
+
+	if remaining := b.maxBodyBytes - b.body.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.body.Write(p[:remaining])
+		} else {
+			b.body.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+func (b *bufferWriter) result() *http.Response {
+	statusCode := b.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     b.header,
+		Body:       io.NopCloser(&b.body),
+	}
+}
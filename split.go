@@ -0,0 +1,80 @@
+package baker
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"sort"
+)
+
+// Split distributes the traffic of a route between the versions of its endpoints.
+// Weights are relative, e.g. `{"v1": 95, "v2": 5}`. If Cookie or Header is set, the
+// assignment is sticky, the cookie holds the selected version and the header value
+// is hashed, so the same value is always routed to the same version.
+type Split struct {
+	Weights map[string]int `json:"weights"`
+	Cookie  string         `json:"cookie"`
+	Header  string         `json:"header"`
+}
+
+func (s *Split) validate() error {
+	for version, weight := range s.Weights {
+		if weight < 0 {
+			return fmt.Errorf("negative weight for version %q", version)
+		}
+	}
+
+	return nil
+}
+
+// pick returns the candidates of the version selected for r
+func (s *Split) pick(r *http.Request, candidates []*value) []*value {
+	byVersion := make(map[string][]*value)
+	for _, candidate := range candidates {
+		byVersion[candidate.endpoint.Version] = append(byVersion[candidate.endpoint.Version], candidate)
+	}
+
+	if s.Cookie != "" {
+		if cookie, err := r.Cookie(s.Cookie); err == nil {
+			if values, ok := byVersion[cookie.Value]; ok {
+				return values
+			}
+		}
+	}
+
+	// versions are sorted so the same header value
+	// always lands on the same version
+	versions := make([]string, 0, len(byVersion))
+	total := 0
+	for version := range byVersion {
+		if weight := s.Weights[version]; weight > 0 {
+			versions = append(versions, version)
+			total += weight
+		}
+	}
+
+	if total == 0 {
+		return candidates
+	}
+
+	sort.Strings(versions)
+
+	var n int
+	if value := r.Header.Get(s.Header); s.Header != "" && value != "" {
+		h := fnv.New32a()
+		h.Write([]byte(value))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+
+	for _, version := range versions {
+		n -= s.Weights[version]
+		if n < 0 {
+			return byVersion[version]
+		}
+	}
+
+	return candidates
+}
@@ -0,0 +1,185 @@
+package baker
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alinz/baker.go/pkg/log"
+)
+
+const (
+	defaultUDPIdleTimeout = 30 * time.Second
+	defaultMaxUDPSessions = 10000
+	maxDatagramSize       = 64 * 1024
+)
+
+// udpSession binds a client to a container, every datagram of the client
+// is sent to the same container until the session expires
+type udpSession struct {
+	client      net.Addr
+	upstream    net.Conn
+	container   *Container
+	idleTimeout time.Duration
+	lastActive  atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleUntil() time.Time {
+	return time.Unix(0, s.lastActive.Load()).Add(s.idleTimeout)
+}
+
+// ServeUDP reads the datagrams of conn and forwards them to the containers of
+// the endpoints whose Port is the port conn listens on and Protocol is udp. The
+// replies of the container are sent back to the client. Once there are as many
+// sessions as set by WithMaxUDPSessions, the datagrams of new clients are dropped.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("%s is not a udp address", conn.LocalAddr())
+	}
+
+	key := udpKey(addr.Port)
+
+	// a session is only closed once it is removed from sessions, which is
+	// done under mu, and only if it wasn't touched since it was found idle,
+	// so a datagram is never written to a closed session
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	remove := func(session *udpSession, idle bool) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if idle && time.Now().Before(session.idleUntil()) {
+			return false
+		}
+
+		if sessions[session.client.String()] == session {
+			delete(sessions, session.client.String())
+		}
+
+		return true
+	}
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		session, ok := sessions[client.String()]
+		if ok {
+			session.touch()
+		}
+		full := len(sessions) >= s.maxUDPSessions
+		mu.Unlock()
+
+		if !ok {
+			if full {
+				log.Debug().
+					Str("client", client.String()).
+					Msg("too many udp sessions, dropping datagram")
+				continue
+			}
+
+			service, ok := s.layer4.Get(key)
+			if !ok {
+				continue
+			}
+
+			session, err = s.newUDPSession(client, service)
+			if err != nil {
+				continue
+			}
+
+			mu.Lock()
+			sessions[client.String()] = session
+			mu.Unlock()
+
+			go func() {
+				s.relayUDP(conn, session, func() bool {
+					return remove(session, true)
+				})
+
+				remove(session, false)
+				session.upstream.Close()
+			}()
+		}
+
+		session.upstream.Write(buf[:n])
+	}
+}
+
+func (s *Server) newUDPSession(client net.Addr, service *Service) (*udpSession, error) {
+	container, endpoint, ok := service.Pick()
+	if !ok {
+		return nil, errors.New("no container available")
+	}
+
+	addr := endpoint.targetAddr(container)
+
+	upstream, err := net.Dial("udp", addr.String())
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("container_id", container.ID).
+			Str("addr", addr.String()).
+			Msg("failed to reach the container")
+		return nil, err
+	}
+
+	session := &udpSession{
+		client: client,
+		// tracked, so the session ends once the container is drained
+		upstream:    newUpgradedConn(upstream, container, nil),
+		container:   container,
+		idleTimeout: endpoint.IdleTimeout.Duration,
+	}
+
+	if session.idleTimeout <= 0 {
+		session.idleTimeout = defaultUDPIdleTimeout
+	}
+
+	session.touch()
+
+	return session, nil
+}
+
+// relayUDP sends the replies of the container back to the client until
+// expire reports that the session is idle for too long
+func (s *Server) relayUDP(conn net.PacketConn, session *udpSession, expire func() bool) {
+	session.container.active.Add(1)
+	defer session.container.active.Add(-1)
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		session.upstream.SetReadDeadline(session.idleUntil())
+
+		n, err := session.upstream.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the client might have sent something in the meantime
+			if !expire() {
+				continue
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		session.touch()
+		conn.WriteTo(buf[:n], session.client)
+	}
+}
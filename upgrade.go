@@ -0,0 +1,250 @@
+package baker
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alinz/baker.go/rule"
+)
+
+// Upgrade configures the connections of an endpoint which are upgraded to
+// another protocol, e.g. WebSocket. Upgrades are allowed unless Disabled is set
+// and, if Protocols is set, only for the listed protocols. Once upgraded, the
+// connection is closed if no data is exchanged for IdleTimeout, or once it has
+// been open for MaxLifetime.
+type Upgrade struct {
+	Disabled    bool          `json:"disabled"`
+	Protocols   []string      `json:"protocols"`
+	IdleTimeout rule.Duration `json:"idle_timeout"`
+	MaxLifetime rule.Duration `json:"max_lifetime"`
+}
+
+func (u *Upgrade) validate() error {
+	if u.IdleTimeout.Duration < 0 || u.MaxLifetime.Duration < 0 {
+		return fmt.Errorf("negative timeout")
+	}
+
+	return nil
+}
+
+// allows reports whether the endpoint accepts an upgrade to protocol
+func (u *Upgrade) allows(protocol string) bool {
+	if u == nil {
+		return true
+	}
+
+	if u.Disabled {
+		return false
+	}
+
+	if len(u.Protocols) == 0 {
+		return true
+	}
+
+	for _, allowed := range u.Protocols {
+		if strings.EqualFold(allowed, protocol) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upgradeProtocol returns the protocol requested by an upgrade
+// request, or an empty string if r is not one
+func upgradeProtocol(r *http.Request) string {
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				protocol, _, _ := strings.Cut(r.Header.Get("Upgrade"), ",")
+				return strings.ToLower(strings.TrimSpace(protocol))
+			}
+		}
+	}
+
+	return ""
+}
+
+// connections keeps track of the upgraded connections of a container,
+// its zero value is ready to use
+type connections struct {
+	mu    sync.Mutex
+	conns map[*upgradedConn]struct{}
+}
+
+func (c *connections) add(conn *upgradedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conns == nil {
+		c.conns = make(map[*upgradedConn]struct{})
+	}
+	c.conns[conn] = struct{}{}
+}
+
+func (c *connections) remove(conn *upgradedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.conns, conn)
+}
+
+func (c *connections) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.conns)
+}
+
+func (c *connections) closeAll() {
+	c.mu.Lock()
+	conns := make([]*upgradedConn, 0, len(c.conns))
+	for conn := range c.conns {
+		conns = append(conns, conn)
+	}
+	c.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// upgradedConn is the client side of an upgraded connection, it enforces
+// the timeouts of the endpoint and is closed when its container is drained
+type upgradedConn struct {
+	net.Conn
+	container   *Container
+	idleTimeout time.Duration
+	idle        *time.Timer
+	lifetime    *time.Timer
+	closeOnce   sync.Once
+}
+
+func newUpgradedConn(conn net.Conn, container *Container, upgrade *Upgrade) *upgradedConn {
+	uc := &upgradedConn{
+		Conn:      conn,
+		container: container,
+	}
+
+	if upgrade != nil {
+		uc.idleTimeout = upgrade.IdleTimeout.Duration
+
+		if uc.idleTimeout > 0 {
+			uc.idle = time.AfterFunc(uc.idleTimeout, func() { uc.Close() })
+		}
+
+		if upgrade.MaxLifetime.Duration > 0 {
+			uc.lifetime = time.AfterFunc(upgrade.MaxLifetime.Duration, func() { uc.Close() })
+		}
+	}
+
+	container.conns.add(uc)
+
+	return uc
+}
+
+// touch postpones the idle timeout, data in either direction counts
+func (uc *upgradedConn) touch() {
+	if uc.idle != nil {
+		uc.idle.Reset(uc.idleTimeout)
+	}
+}
+
+func (uc *upgradedConn) Read(b []byte) (int, error) {
+	n, err := uc.Conn.Read(b)
+	if n > 0 {
+		uc.touch()
+	}
+	return n, err
+}
+
+func (uc *upgradedConn) Write(b []byte) (int, error) {
+	n, err := uc.Conn.Write(b)
+	if n > 0 {
+		uc.touch()
+	}
+	return n, err
+}
+
+// CloseWrite closes the writing side of the connection, if supported
+func (uc *upgradedConn) CloseWrite() error {
+	if cw, ok := uc.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return uc.Conn.Close()
+}
+
+func (uc *upgradedConn) Close() error {
+	var err error
+
+	uc.closeOnce.Do(func() {
+		if uc.idle != nil {
+			uc.idle.Stop()
+		}
+		if uc.lifetime != nil {
+			uc.lifetime.Stop()
+		}
+
+		uc.container.conns.remove(uc)
+		err = uc.Conn.Close()
+	})
+
+	return err
+}
+
+// upgradeWriter hands out the hijacked connection of an upgrade
+// request wrapped, so it is tracked by its container
+type upgradeWriter struct {
+	http.ResponseWriter
+	container *Container
+	upgrade   *Upgrade
+}
+
+var _ http.Hijacker = (*upgradeWriter)(nil)
+
+func (uw *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(uw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newUpgradedConn(conn, uw.container, uw.upgrade), brw, nil
+}
+
+func (uw *upgradeWriter) Unwrap() http.ResponseWriter {
+	return uw.ResponseWriter
+}
+
+// drain stops routing requests to container and closes its upgraded
+// connections, which are given timeout to be closed by either side
+func (s *Server) drain(container *Container, timeout time.Duration) {
+	container.draining.Store(true)
+
+	deadline := time.Now().Add(timeout)
+	for container.conns.len() > 0 && time.Now().Before(deadline) {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	container.conns.closeAll()
+}
+
+// SetDraining stops routing new requests to a container, or resumes it.
+// Requests in progress and upgraded connections are not interrupted.
+func (s *Server) SetDraining(id string, draining bool) bool {
+	container, ok := s.containers.Get(id)
+	if !ok {
+		return false
+	}
+
+	container.draining.Store(draining)
+	return true
+}